@@ -0,0 +1,132 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/printer"
+)
+
+// ErrOperationNotAllowed is returned when adding a subscription whose
+// document is not in the operation allowlist.
+var ErrOperationNotAllowed = errors.New("Subscription operation is not in the allowlist")
+
+// OperationAllowlist defines the trusted documents that clients are
+// allowed to subscribe with.
+type OperationAllowlist interface {
+	// Allows returns true if the document is a trusted document.
+	Allows(*ast.Document) bool
+
+	// Reload reloads the trusted documents from their source.
+	Reload() error
+}
+
+// apolloPersistedQueryManifest is the manifest format generated by
+// Apollo's persisted query tooling.
+type apolloPersistedQueryManifest struct {
+	Format     string `json:"format"`
+	Operations []struct {
+		ID   string `json:"id"`
+		Body string `json:"body"`
+	} `json:"operations"`
+}
+
+/**
+ * The default implementation of the OperationAllowlist interface.
+ */
+
+type operationAllowlist struct {
+	mutex     sync.RWMutex
+	path      string
+	documents map[string]string
+}
+
+// NewOperationAllowlist creates an allowlist from a manifest file of
+// trusted operations. The manifest is a JSON object mapping hashes to
+// documents, as produced by GraphQL codegen tools; Apollo's persisted
+// query manifest format is supported as well.
+func NewOperationAllowlist(path string) (OperationAllowlist, error) {
+	allowlist := new(operationAllowlist)
+	allowlist.path = path
+	if err := allowlist.Reload(); err != nil {
+		return nil, err
+	}
+	return allowlist, nil
+}
+
+func (a *operationAllowlist) Allows(document *ast.Document) bool {
+	normalized, ok := normalizeDocument(document)
+	if !ok {
+		return false
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	_, ok = a.documents[normalized]
+	return ok
+}
+
+func (a *operationAllowlist) Reload() error {
+	contents, err := ioutil.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := parseOperationManifest(contents)
+	if err != nil {
+		return err
+	}
+
+	// Index the trusted documents by their normalized text
+	documents := make(map[string]string, len(manifest))
+	for hash, query := range manifest {
+		document, err := parser.Parse(parser.ParseParams{
+			Source: query,
+		})
+		if err != nil {
+			return fmt.Errorf("Invalid document %s in allowlist: %v", hash, err)
+		}
+		normalized, ok := normalizeDocument(document)
+		if !ok {
+			return fmt.Errorf("Invalid document %s in allowlist", hash)
+		}
+		documents[normalized] = hash
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.documents = documents
+	return nil
+}
+
+func parseOperationManifest(contents []byte) (map[string]string, error) {
+	apollo := apolloPersistedQueryManifest{}
+	if err := json.Unmarshal(contents, &apollo); err == nil && apollo.Format != "" {
+		manifest := make(map[string]string, len(apollo.Operations))
+		for _, operation := range apollo.Operations {
+			manifest[operation.ID] = operation.Body
+		}
+		return manifest, nil
+	}
+
+	manifest := make(map[string]string)
+	if err := json.Unmarshal(contents, &manifest); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// normalizeDocument prints a document in a canonical form, so that
+// documents differing only in formatting can be compared.
+func normalizeDocument(document *ast.Document) (string, bool) {
+	if document == nil {
+		return "", false
+	}
+	normalized, ok := printer.Print(document).(string)
+	return normalized, ok
+}
@@ -0,0 +1,98 @@
+package graphqlws_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/graphql-go/graphql"
+)
+
+func TestAllowlist_OnlyTrustedDocumentsCanBeSubscribed(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{
+					Type: graphql.String,
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+				"posts": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		})})
+
+	dir, err := ioutil.TempDir("", "graphqlws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "manifest.json")
+	manifest := `{"abc": "subscription Users { users }"}`
+	if err := ioutil.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	allowlist, err := graphqlws.NewOperationAllowlist(path)
+	if err != nil {
+		t.Fatal("NewOperationAllowlist fails loading a manifest:", err)
+	}
+
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema:    &schema,
+		Allowlist: allowlist,
+	})
+
+	conn := mockWebSocketConnection{id: "1"}
+	subscribe := func(id string, query string) []error {
+		return sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      query,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+
+	// Trusted documents are matched regardless of their formatting
+	if errors := subscribe("1", "subscription Users {\n  users\n}"); len(errors) > 0 {
+		t.Error("AddSubscription rejects trusted documents:", errors)
+	}
+
+	errors := subscribe("2", "subscription Posts { posts }")
+	if len(errors) != 1 || errors[0] != graphqlws.ErrOperationNotAllowed {
+		t.Error("AddSubscription accepts untrusted documents:", errors)
+	}
+
+	// Reloading the allowlist picks up new trusted documents
+	manifest = `{
+	  "format": "apollo-persisted-query-manifest",
+	  "version": 1,
+	  "operations": [
+	    {"id": "abc", "name": "Users", "type": "subscription", "body": "subscription Users { users }"},
+	    {"id": "def", "name": "Posts", "type": "subscription", "body": "subscription Posts { posts }"}
+	  ]
+	}`
+	if err := ioutil.WriteFile(path, []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := allowlist.Reload(); err != nil {
+		t.Fatal("Reload fails loading a manifest:", err)
+	}
+
+	if errors := subscribe("2", "subscription Posts { posts }"); len(errors) > 0 {
+		t.Error("AddSubscription rejects documents added by reloading:", errors)
+	}
+}
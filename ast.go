@@ -1,6 +1,8 @@
 package graphqlws
 
 import (
+	"strconv"
+
 	"github.com/graphql-go/graphql/language/ast"
 )
 
@@ -21,6 +23,26 @@ func operationDefinitionsWithOperation(
 	return defs
 }
 
+func operationDefinitions(doc *ast.Document) []*ast.OperationDefinition {
+	defs := []*ast.OperationDefinition{}
+	for _, node := range doc.Definitions {
+		if def, ok := node.(*ast.OperationDefinition); ok {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+func fragmentDefinitions(doc *ast.Document) map[string]*ast.FragmentDefinition {
+	defs := make(map[string]*ast.FragmentDefinition)
+	for _, node := range doc.Definitions {
+		if def, ok := node.(*ast.FragmentDefinition); ok && def.Name != nil {
+			defs[def.Name.Value] = def
+		}
+	}
+	return defs
+}
+
 func selectionSetsForOperationDefinitions(
 	defs []*ast.OperationDefinition,
 ) []*ast.SelectionSet {
@@ -35,7 +57,7 @@ func selectionSetsForOperationDefinitions(
 
 func nameForSelectionSet(set *ast.SelectionSet) (string, bool) {
 	if len(set.Selections) >= 1 {
-		if field, ok := set.Selections[0].(*ast.Field); ok {
+		if field, ok := set.Selections[0].(*ast.Field); ok && field.Name != nil {
 			return field.Name.Value, true
 		}
 	}
@@ -57,3 +79,93 @@ func subscriptionFieldNamesFromDocument(doc *ast.Document) []string {
 	sets := selectionSetsForOperationDefinitions(defs)
 	return namesForSelectionSets(sets)
 }
+
+// subscriptionRootFields returns the first root field of the
+// subscription operations in a document, or of the named operation
+// only; see singleSubscriptionRootField.
+func subscriptionRootFields(doc *ast.Document, operationName string) []*ast.Field {
+	fields := []*ast.Field{}
+	for _, def := range operationDefinitionsWithOperation(doc, "subscription") {
+		if operationName != "" && (def.Name == nil || def.Name.Value != operationName) {
+			continue
+		}
+		if set := def.GetSelectionSet(); set != nil && len(set.Selections) >= 1 {
+			if field, ok := set.Selections[0].(*ast.Field); ok && field.Name != nil {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// singleSubscriptionRootField checks that the subscription operations
+// in a document, or the named operation only, select a single root
+// field each.
+func singleSubscriptionRootField(doc *ast.Document, operationName string) bool {
+	for _, def := range operationDefinitionsWithOperation(doc, "subscription") {
+		if operationName != "" && (def.Name == nil || def.Name.Value != operationName) {
+			continue
+		}
+		set := def.GetSelectionSet()
+		if set == nil || len(set.Selections) != 1 {
+			return false
+		}
+		if _, ok := set.Selections[0].(*ast.Field); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// argumentValues returns the values of the arguments of a field,
+// substituting the given variables.
+func argumentValues(field *ast.Field, variables map[string]interface{}) map[string]interface{} {
+	args := make(map[string]interface{}, len(field.Arguments))
+	for _, arg := range field.Arguments {
+		if arg.Name != nil {
+			args[arg.Name.Value] = valueFromAST(arg.Value, variables)
+		}
+	}
+	return args
+}
+
+func valueFromAST(value ast.Value, variables map[string]interface{}) interface{} {
+	switch value := value.(type) {
+	case *ast.Variable:
+		if value.Name == nil {
+			return nil
+		}
+		return variables[value.Name.Value]
+	case *ast.IntValue:
+		if i, err := strconv.ParseInt(value.Value, 10, 64); err == nil {
+			return int(i)
+		}
+		return value.Value
+	case *ast.FloatValue:
+		if f, err := strconv.ParseFloat(value.Value, 64); err == nil {
+			return f
+		}
+		return value.Value
+	case *ast.StringValue:
+		return value.Value
+	case *ast.BooleanValue:
+		return value.Value
+	case *ast.EnumValue:
+		return value.Value
+	case *ast.ListValue:
+		list := make([]interface{}, len(value.Values))
+		for i, item := range value.Values {
+			list[i] = valueFromAST(item, variables)
+		}
+		return list
+	case *ast.ObjectValue:
+		object := make(map[string]interface{}, len(value.Fields))
+		for _, field := range value.Fields {
+			if field.Name != nil {
+				object[field.Name.Value] = valueFromAST(field.Value, variables)
+			}
+		}
+		return object
+	}
+	return nil
+}
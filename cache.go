@@ -0,0 +1,198 @@
+package graphqlws
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// DefaultDocumentCacheSize is the number of query documents kept by a
+// document cache created with a non-positive size.
+const DefaultDocumentCacheSize = 1000
+
+// CachedDocument holds the result of parsing and validating a query
+// against a schema.
+type CachedDocument struct {
+	// Document is the parsed GraphQL AST of the query.
+	Document *ast.Document
+
+	// Errors are the errors from validating the document against the
+	// schema; the document is valid if there are none.
+	Errors []error
+
+	// Fields are the names of the top-level subscription fields.
+	Fields []string
+}
+
+// DocumentCacheStats provides statistics about the usage of a
+// document cache.
+type DocumentCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Size      int
+	Capacity  int
+}
+
+// DocumentCache stores parsed and validated query documents so that
+// subscriptions using the same query text do not have to be parsed
+// and validated over and over again.
+type DocumentCache interface {
+	// Get returns the cached document for a query and schema, if any.
+	Get(*graphql.Schema, string) (*CachedDocument, bool)
+
+	// Add stores the document for a query and schema. Adding a document
+	// for a different schema than before invalidates all documents of
+	// the previous schema.
+	Add(*graphql.Schema, string, *CachedDocument)
+
+	// Purge removes all documents from the cache.
+	Purge()
+
+	// Stats returns the hit/miss statistics of the cache.
+	Stats() DocumentCacheStats
+}
+
+// loadDocument parses a query and validates it against a schema,
+// consulting a document cache first if there is one. It only fails if
+// the query cannot be parsed.
+func loadDocument(schema *graphql.Schema, cache DocumentCache, query string) (*CachedDocument, error) {
+	if cache != nil {
+		if document, ok := cache.Get(schema, query); ok {
+			return document, nil
+		}
+	}
+
+	document, err := parser.Parse(parser.ParseParams{
+		Source: query,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	validation := graphql.ValidateDocument(schema, document, nil)
+	cached := &CachedDocument{
+		Document: document,
+		Errors:   ErrorsFromGraphQLErrors(validation.Errors),
+		Fields:   subscriptionFieldNamesFromDocument(document),
+	}
+
+	// Only cache valid documents, so that junk queries cannot evict them
+	if cache != nil && validation.IsValid {
+		cache.Add(schema, query, cached)
+	}
+	return cached, nil
+}
+
+/**
+ * The default implementation of the DocumentCache interface.
+ */
+
+type documentCacheKey struct {
+	schema *graphql.Schema
+	query  string
+}
+
+type documentCacheEntry struct {
+	key      documentCacheKey
+	document *CachedDocument
+}
+
+type documentCache struct {
+	mutex    sync.Mutex
+	capacity int
+	schema   *graphql.Schema
+	entries  map[documentCacheKey]*list.Element
+	order    *list.List
+	stats    DocumentCacheStats
+}
+
+// NewDocumentCache creates an LRU document cache holding up to size
+// documents.
+func NewDocumentCache(size int) DocumentCache {
+	if size <= 0 {
+		size = DefaultDocumentCacheSize
+	}
+	cache := new(documentCache)
+	cache.capacity = size
+	cache.entries = make(map[documentCacheKey]*list.Element)
+	cache.order = list.New()
+	return cache
+}
+
+func (c *documentCache) Get(
+	schema *graphql.Schema,
+	query string,
+) (*CachedDocument, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.entries[documentCacheKey{schema, query}]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*documentCacheEntry).document, true
+}
+
+func (c *documentCache) Add(
+	schema *graphql.Schema,
+	query string,
+	document *CachedDocument,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Documents validated against a previous schema are stale
+	if c.schema != schema {
+		c.purge()
+		c.schema = schema
+	}
+
+	key := documentCacheKey{schema, query}
+	if element, ok := c.entries[key]; ok {
+		element.Value.(*documentCacheEntry).document = document
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&documentCacheEntry{
+		key:      key,
+		document: document,
+	})
+
+	// Evict the least recently used documents if the cache is full
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*documentCacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *documentCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.purge()
+}
+
+func (c *documentCache) purge() {
+	c.entries = make(map[documentCacheKey]*list.Element)
+	c.order.Init()
+}
+
+func (c *documentCache) Stats() DocumentCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
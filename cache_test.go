@@ -0,0 +1,117 @@
+package graphqlws_test
+
+import (
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/graphql-go/graphql"
+)
+
+func TestDocumentCache_EvictsLeastRecentlyUsedDocuments(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{})
+	cache := graphqlws.NewDocumentCache(2)
+
+	cache.Add(&schema, "a", &graphqlws.CachedDocument{})
+	cache.Add(&schema, "b", &graphqlws.CachedDocument{})
+
+	// Touch "a" so that "b" becomes the least recently used document
+	cache.Get(&schema, "a")
+	cache.Add(&schema, "c", &graphqlws.CachedDocument{})
+
+	if _, ok := cache.Get(&schema, "b"); ok {
+		t.Error("DocumentCache does not evict the least recently used document")
+	}
+	if _, ok := cache.Get(&schema, "a"); !ok {
+		t.Error("DocumentCache evicts recently used documents")
+	}
+
+	stats := cache.Stats()
+	if stats.Size != 2 || stats.Capacity != 2 || stats.Evictions != 1 {
+		t.Error("DocumentCache reports unexpected stats:", stats)
+	}
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Error("DocumentCache reports unexpected hits/misses:", stats)
+	}
+}
+
+func TestDocumentCache_InvalidatesDocumentsWhenTheSchemaChanges(t *testing.T) {
+	schema1, _ := graphql.NewSchema(graphql.SchemaConfig{})
+	schema2, _ := graphql.NewSchema(graphql.SchemaConfig{})
+	cache := graphqlws.NewDocumentCache(10)
+
+	cache.Add(&schema1, "a", &graphqlws.CachedDocument{})
+	cache.Add(&schema2, "b", &graphqlws.CachedDocument{})
+
+	if _, ok := cache.Get(&schema1, "a"); ok {
+		t.Error("DocumentCache keeps documents of a previous schema")
+	}
+	if _, ok := cache.Get(&schema2, "b"); !ok {
+		t.Error("DocumentCache does not store documents of the new schema")
+	}
+}
+
+func TestDocumentCache_SubscriptionManagerReusesCachedDocuments(t *testing.T) {
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{
+					Type: graphql.String,
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(graphql.String),
+				},
+			},
+		})})
+	cache := graphqlws.NewDocumentCache(10)
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema:        &schema,
+		DocumentCache: cache,
+	})
+
+	conn := mockWebSocketConnection{id: "1"}
+
+	for _, id := range []string{"1", "2"} {
+		errors := sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      "subscription { users }",
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+		if len(errors) > 0 {
+			t.Fatal("AddSubscription fails with a document cache:", errors)
+		}
+	}
+
+	sub1 := sm.Subscriptions()[&conn]["1"]
+	sub2 := sm.Subscriptions()[&conn]["2"]
+	if sub1.Document != sub2.Document || len(sub2.Fields) != 1 || sub2.Fields[0] != "users" {
+		t.Error("AddSubscription does not reuse cached documents")
+	}
+
+	// Invalid queries are not cached, so they cannot evict valid ones
+	for i := 0; i < 2; i++ {
+		errors := sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         "3",
+			Connection: &conn,
+			Query:      "subscription { foo }",
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+		if len(errors) == 0 {
+			t.Error("AddSubscription doesn't fail for invalid queries")
+		}
+	}
+
+	if stats := cache.Stats(); stats.Hits != 1 || stats.Misses != 3 || stats.Size != 1 {
+		t.Error("DocumentCache reports unexpected hits/misses:", stats)
+	}
+}
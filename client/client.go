@@ -0,0 +1,706 @@
+// Package client implements a client for the GraphQL over WebSocket
+// protocol, as served by graphqlws.NewHandler.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Constants for operation message types
+	gqlConnectionInit      = "connection_init"
+	gqlConnectionAck       = "connection_ack"
+	gqlConnectionKeepAlive = "ka"
+	gqlConnectionError     = "connection_error"
+	gqlConnectionTerminate = "connection_terminate"
+	gqlStart               = "start"
+	gqlData                = "data"
+	gqlError               = "error"
+	gqlComplete            = "complete"
+	gqlStop                = "stop"
+
+	// Subprotocol implemented by the client
+	subprotocol = "graphql-ws"
+
+	// Default timeout for the server to acknowledge the connection
+	defaultAckTimeout = 10 * time.Second
+
+	// Default number of results buffered per subscription
+	defaultResultBuffer = 16
+
+	// Timeout for outgoing messages
+	writeTimeout = 10 * time.Second
+)
+
+var (
+	// ErrClosed is returned when using a client that has been closed.
+	ErrClosed = errors.New("Client is closed")
+
+	// ErrKeepAliveTimeout is reported when the server has not sent any
+	// message within the keep-alive timeout.
+	ErrKeepAliveTimeout = errors.New("Server stopped sending keep-alive messages")
+
+	// ErrResultBufferFull is reported when a subscription's results are
+	// not consumed fast enough to fit in its buffer; the subscription is
+	// stopped rather than holding up the results of all others.
+	ErrResultBufferFull = errors.New("Subscription result buffer is full")
+)
+
+// Config defines the configuration parameters of a client.
+type Config struct {
+	// URL is the WebSocket URL of the server (ws:// or wss://).
+	URL string
+
+	// Header is sent along with the WebSocket handshake.
+	Header http.Header
+
+	// Dialer is used to establish the WebSocket connection; defaults to
+	// websocket.DefaultDialer.
+	Dialer *websocket.Dialer
+
+	// InitPayload is sent as the payload of the connection_init message,
+	// e.g. graphqlws.InitMessagePayload{AuthToken: "..."}.
+	InitPayload interface{}
+
+	// AckTimeout is how long to wait for the server to acknowledge the
+	// connection; defaults to 10 seconds.
+	AckTimeout time.Duration
+
+	// KeepAliveTimeout closes the connection if the server sends no
+	// message (including keep-alives) for this long; zero disables it.
+	KeepAliveTimeout time.Duration
+
+	// ResultBuffer is the number of results buffered per subscription;
+	// defaults to 16. Subscriptions whose buffer overflows are stopped
+	// with ErrResultBufferFull.
+	ResultBuffer int
+
+	// OnError is called with errors that are not associated with an
+	// operation, such as connection errors sent by the server.
+	OnError func(error)
+
+	// Reconnect re-establishes the connection with exponential backoff
+	// when it is lost, and restarts all active subscriptions with their
+	// original IDs. Subscriptions that received results with a cursor
+	// resume after the last of them, so that servers with an event
+	// history replay what was missed. Servers that support sessions
+	// resume the subscriptions themselves, which are then not restarted.
+	// The initial Dial is not retried.
+	Reconnect bool
+
+	// MinBackoff is the delay before the first reconnection attempt;
+	// defaults to 500 milliseconds.
+	MinBackoff time.Duration
+
+	// MaxBackoff is the maximum delay between reconnection attempts;
+	// defaults to 30 seconds.
+	MaxBackoff time.Duration
+
+	// MaxReconnectAttempts is the number of consecutive failed attempts
+	// after which the client gives up; zero means it never gives up.
+	MaxReconnectAttempts int
+
+	// OnStateChange is called whenever the connection state changes,
+	// along with the error that caused the change, if any.
+	OnStateChange func(State, error)
+}
+
+// Error is a GraphQL error returned by the server.
+type Error struct {
+	Message    string                 `json:"message"`
+	Locations  []ErrorLocation        `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// ErrorLocation is a location in a query that an error refers to.
+type ErrorLocation struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+func (err *Error) Error() string {
+	return err.Message
+}
+
+// OperationError is the error of an operation that the server
+// rejected or aborted.
+type OperationError struct {
+	Errors []Error
+}
+
+func (err *OperationError) Error() string {
+	if len(err.Errors) == 1 {
+		return err.Errors[0].Message
+	}
+	return fmt.Sprintf("%d errors, first: %s", len(err.Errors), err.Errors[0].Message)
+}
+
+// Result is a result of a subscription sent by the server. If Err is
+// set, the subscription has ended and no more results follow; this
+// includes results that fail to decode. GraphQL errors of individual
+// results are reported in Errors instead.
+type Result struct {
+	Data       json.RawMessage                  `json:"data"`
+	Errors     []Error                          `json:"errors"`
+	Extensions *graphqlws.DataMessageExtensions `json:"extensions"`
+	Err        error                            `json:"-"`
+}
+
+// Decode decodes the data of the result into v.
+func (r *Result) Decode(v interface{}) error {
+	if r.Err != nil {
+		return r.Err
+	}
+	return json.Unmarshal(r.Data, v)
+}
+
+// incomingMessage is an operation message received from the server.
+type incomingMessage struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Client is a GraphQL over WebSocket client.
+type Client struct {
+	config Config
+	logger *log.Entry
+
+	ws         *websocket.Conn
+	writeMutex sync.Mutex
+
+	mutex      sync.Mutex
+	operations map[string]*operation
+	nextID     uint64
+	lastSeen   time.Time
+	session    string
+	err        error
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Dial connects to a GraphQL WebSocket server, negotiates the
+// graphql-ws subprotocol and initializes the connection.
+func Dial(ctx context.Context, config Config) (*Client, error) {
+	if config.Dialer == nil {
+		config.Dialer = websocket.DefaultDialer
+	}
+	if config.AckTimeout <= 0 {
+		config.AckTimeout = defaultAckTimeout
+	}
+	if config.ResultBuffer <= 0 {
+		config.ResultBuffer = defaultResultBuffer
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+
+	client := new(Client)
+	client.config = config
+	client.logger = graphqlws.NewLogger("client")
+	client.operations = make(map[string]*operation)
+	client.done = make(chan struct{})
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+
+	client.setState(StateConnecting, nil)
+	ws, _, err := client.connect(ctx)
+	if err != nil {
+		client.cancel()
+		client.setState(StateClosed, err)
+		return nil, err
+	}
+	client.ws = ws
+	client.lastSeen = time.Now()
+	client.setState(StateConnected, nil)
+
+	go client.readLoop(ws)
+
+	return client, nil
+}
+
+// connect establishes a WebSocket connection and waits for the server
+// to acknowledge the connection_init message. It returns the IDs of
+// the operations resumed by the server, if it resumed the session.
+func (c *Client) connect(ctx context.Context) (*websocket.Conn, map[string]bool, error) {
+	dialer := *c.config.Dialer
+	dialer.Subprotocols = []string{subprotocol}
+
+	payload, err := c.initPayload()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ws, _, err := dialer.DialContext(ctx, c.config.URL, c.config.Header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ws.Subprotocol() != subprotocol {
+		ws.Close()
+		return nil, nil, fmt.Errorf("Server does not implement the %s protocol", subprotocol)
+	}
+
+	// Abort the handshake if the context is cancelled
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	if err := writeMessage(ws, graphqlws.OperationMessage{
+		Type:    gqlConnectionInit,
+		Payload: payload,
+	}); err != nil {
+		ws.Close()
+		return nil, nil, err
+	}
+
+	// Wait for the server to acknowledge the connection
+	deadline := time.Now().Add(c.config.AckTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	ws.SetReadDeadline(deadline)
+	defer ws.SetReadDeadline(time.Time{})
+
+	for {
+		msg := incomingMessage{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			ws.Close()
+			return nil, nil, err
+		}
+
+		switch msg.Type {
+		case gqlConnectionAck:
+			// Remember the session of servers that support resuming it
+			ack := graphqlws.ConnectionAckPayload{}
+			if len(msg.Payload) == 0 || json.Unmarshal(msg.Payload, &ack) != nil {
+				return ws, nil, nil
+			}
+			c.mutex.Lock()
+			c.session = ack.SessionToken
+			c.mutex.Unlock()
+
+			var resumed map[string]bool
+			if ack.Resumed {
+				resumed = make(map[string]bool, len(ack.Operations))
+				for _, id := range ack.Operations {
+					resumed[id] = true
+				}
+			}
+			return ws, resumed, nil
+		case gqlConnectionError:
+			ws.Close()
+			return nil, nil, fmt.Errorf("Connection rejected: %v", decodeError(msg.Payload))
+		case gqlConnectionKeepAlive:
+			// Keep waiting for the acknowledgement
+		default:
+			ws.Close()
+			return nil, nil, fmt.Errorf("Unexpected %q message before connection_ack", msg.Type)
+		}
+	}
+}
+
+// initPayload returns the payload of connection_init messages, along
+// with the token of the session to resume, if there is one.
+func (c *Client) initPayload() (interface{}, error) {
+	// Servers expect an object payload even if there is nothing to send
+	payload := c.config.InitPayload
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+
+	c.mutex.Lock()
+	session := c.session
+	c.mutex.Unlock()
+	if session == "" {
+		return payload, nil
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	fields["sessionToken"] = session
+	return fields, nil
+}
+
+// Subscribe starts a subscription. Results are delivered on the
+// returned channel, which is closed when the subscription ends. The
+// subscription is stopped when the context is cancelled.
+func (c *Client) Subscribe(
+	ctx context.Context,
+	query string,
+	variables map[string]interface{},
+) (<-chan *Result, error) {
+	return c.SubscribeWithPayload(ctx, &graphqlws.StartMessagePayload{
+		Query:     query,
+		Variables: variables,
+	})
+}
+
+// SubscribeWithPayload starts a subscription with a custom start
+// payload, e.g. to set the operation name or extensions.
+func (c *Client) SubscribeWithPayload(
+	ctx context.Context,
+	payload *graphqlws.StartMessagePayload,
+) (<-chan *Result, error) {
+	// Register and start the operation atomically with respect to
+	// reconnects, so that it is started exactly once on each connection
+	c.writeMutex.Lock()
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		c.writeMutex.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextID++
+	op := newOperation(strconv.FormatUint(c.nextID, 10), payload, c.config.ResultBuffer)
+	c.operations[op.id] = op
+	c.mutex.Unlock()
+
+	err := writeMessage(c.ws, graphqlws.OperationMessage{
+		ID:      op.id,
+		Type:    gqlStart,
+		Payload: payload,
+	})
+	c.writeMutex.Unlock()
+
+	// If the connection is broken, the operation is started again after
+	// reconnecting; otherwise starting it has failed
+	if err != nil && !c.config.Reconnect {
+		c.removeOperation(op.id)
+		op.finish(nil)
+		return nil, err
+	}
+
+	// Stop the subscription when the context is cancelled
+	go func() {
+		select {
+		case <-ctx.Done():
+			if c.removeOperation(op.id) {
+				c.write(graphqlws.OperationMessage{ID: op.id, Type: gqlStop})
+				op.finish(nil)
+			}
+		case <-op.done:
+		}
+	}()
+
+	return op.results, nil
+}
+
+// LastKeepAlive returns when the client last received a message
+// (including keep-alives) from the server.
+func (c *Client) LastKeepAlive() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lastSeen
+}
+
+// Done returns a channel that is closed when the client is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error that closed the client, if any.
+func (c *Client) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == ErrClosed {
+		return nil
+	}
+	return c.err
+}
+
+// Close terminates the connection and ends all subscriptions.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.err = ErrClosed
+	c.mutex.Unlock()
+
+	// Stop reconnecting, if we are
+	c.cancel()
+
+	c.writeMutex.Lock()
+	writeMessage(c.ws, graphqlws.OperationMessage{Type: gqlConnectionTerminate})
+	err := c.ws.Close()
+	c.writeMutex.Unlock()
+
+	<-c.done
+	return err
+}
+
+func (c *Client) write(msg graphqlws.OperationMessage) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return writeMessage(c.ws, msg)
+}
+
+func writeMessage(ws *websocket.Conn, msg graphqlws.OperationMessage) error {
+	ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return ws.WriteJSON(msg)
+}
+
+func (c *Client) readLoop(ws *websocket.Conn) {
+	var err error
+	for {
+		err = c.receive(ws)
+		ws.Close()
+		if err == ErrClosed || !c.config.Reconnect {
+			break
+		}
+
+		c.logger.WithField("err", err).Warn("Connection lost, reconnecting")
+		c.setState(StateReconnecting, err)
+		if ws, err = c.reconnect(); err != nil {
+			break
+		}
+	}
+
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	operations := c.operations
+	c.operations = make(map[string]*operation)
+	c.mutex.Unlock()
+
+	// End all subscriptions, reporting why unless the client was closed
+	if c.Err() == nil {
+		err = nil
+	}
+	for _, op := range operations {
+		op.finish(err)
+	}
+
+	c.cancel()
+	c.setState(StateClosed, err)
+	close(c.done)
+}
+
+// receive reads and dispatches messages until the connection fails.
+func (c *Client) receive(ws *websocket.Conn) error {
+	for {
+		if c.config.KeepAliveTimeout > 0 {
+			ws.SetReadDeadline(time.Now().Add(c.config.KeepAliveTimeout))
+		}
+
+		msg := incomingMessage{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			c.mutex.Lock()
+			closed := c.err == ErrClosed
+			c.mutex.Unlock()
+			if closed {
+				return ErrClosed
+			}
+			if netErr, ok := err.(interface{ Timeout() bool }); ok && netErr.Timeout() {
+				return ErrKeepAliveTimeout
+			}
+			return err
+		}
+
+		c.mutex.Lock()
+		c.lastSeen = time.Now()
+		op := c.operations[msg.ID]
+		c.mutex.Unlock()
+
+		c.logger.WithFields(log.Fields{
+			"id":   msg.ID,
+			"type": msg.Type,
+		}).Debug("Received message")
+
+		switch msg.Type {
+		case gqlConnectionKeepAlive:
+			// Nothing to do besides remembering when we last heard from the server
+
+		case gqlData:
+			if op != nil {
+				result := &Result{}
+				if err := json.Unmarshal(msg.Payload, result); err != nil {
+					// Results would be missing from then on, so the
+					// subscription ends
+					if c.removeOperation(msg.ID) {
+						go c.write(graphqlws.OperationMessage{ID: msg.ID, Type: gqlStop})
+						op.finish(fmt.Errorf("Invalid data payload: %v", err))
+					}
+					break
+				}
+				if result.Extensions != nil && result.Extensions.Cursor > 0 {
+					op.setCursor(result.Extensions.Cursor)
+				}
+				if !op.send(result) && c.removeOperation(msg.ID) {
+					// Never hold up the results of other operations
+					go c.write(graphqlws.OperationMessage{ID: msg.ID, Type: gqlStop})
+					op.finish(ErrResultBufferFull)
+				}
+			}
+
+		case gqlError:
+			err := decodeError(msg.Payload)
+			if op != nil && c.removeOperation(msg.ID) {
+				op.finish(err)
+			} else {
+				c.reportError(err)
+			}
+
+		case gqlComplete:
+			if op != nil && c.removeOperation(msg.ID) {
+				op.finish(nil)
+			}
+
+		case gqlConnectionError:
+			c.reportError(fmt.Errorf("Connection error: %v", decodeError(msg.Payload)))
+
+		default:
+			c.logger.WithField("type", msg.Type).Warn("Unhandled message")
+		}
+	}
+}
+
+func (c *Client) removeOperation(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.operations[id]; !ok {
+		return false
+	}
+	delete(c.operations, id)
+	return true
+}
+
+func (c *Client) reportError(err error) {
+	c.logger.WithField("err", err).Warn("Received error")
+	if c.config.OnError != nil {
+		c.config.OnError(err)
+	}
+}
+
+// decodeError decodes the payload of an error message, which is
+// either a list of GraphQL errors, a single error or a string.
+func decodeError(payload json.RawMessage) error {
+	errs := []Error{}
+	if err := json.Unmarshal(payload, &errs); err == nil && len(errs) > 0 {
+		return &OperationError{Errors: errs}
+	}
+
+	single := Error{}
+	if err := json.Unmarshal(payload, &single); err == nil && single.Message != "" {
+		return &OperationError{Errors: []Error{single}}
+	}
+
+	var message string
+	if err := json.Unmarshal(payload, &message); err == nil && message != "" {
+		return &OperationError{Errors: []Error{{Message: message}}}
+	}
+
+	return &OperationError{Errors: []Error{{Message: string(payload)}}}
+}
+
+// operation is a subscription started by the client.
+type operation struct {
+	id      string
+	payload *graphqlws.StartMessagePayload
+	buffer  int
+	results chan *Result
+	done    chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+	closed  bool
+	cursor  uint64
+}
+
+func newOperation(id string, payload *graphqlws.StartMessagePayload, buffer int) *operation {
+	return &operation{
+		id:      id,
+		payload: payload,
+		buffer:  buffer,
+
+		// Keep room for the final error, so that it is never dropped
+		results: make(chan *Result, buffer+1),
+		done:    make(chan struct{}),
+	}
+}
+
+// send buffers a result without blocking. It returns false if the
+// buffer is full.
+func (op *operation) send(result *Result) bool {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	if op.closed {
+		return true
+	}
+	if len(op.results) >= op.buffer {
+		return false
+	}
+	op.results <- result
+	return true
+}
+
+// setCursor remembers the cursor of the last result received.
+func (op *operation) setCursor(cursor uint64) {
+	op.mutex.Lock()
+	defer op.mutex.Unlock()
+	op.cursor = cursor
+}
+
+// resumePayload returns the start payload for restarting the
+// operation, resuming after the last cursor received, if any.
+func (op *operation) resumePayload() *graphqlws.StartMessagePayload {
+	op.mutex.Lock()
+	cursor := op.cursor
+	op.mutex.Unlock()
+	if cursor == 0 {
+		return op.payload
+	}
+
+	payload := *op.payload
+	extensions := graphqlws.StartMessageExtensions{}
+	if payload.Extensions != nil {
+		extensions = *payload.Extensions
+	}
+	extensions.Resume = &graphqlws.ResumeExtension{Cursor: cursor}
+	payload.Extensions = &extensions
+	return &payload
+}
+
+// finish ends the operation, delivering a final error if there is one.
+func (op *operation) finish(err error) {
+	op.once.Do(func() {
+		close(op.done)
+
+		op.mutex.Lock()
+		defer op.mutex.Unlock()
+		op.closed = true
+		if err != nil {
+			op.results <- &Result{Err: err}
+		}
+		close(op.results)
+	})
+}
@@ -0,0 +1,512 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/client"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{
+					Type: graphql.String,
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"greeting": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+func startServer(config graphqlws.HandlerConfig) (*httptest.Server, string) {
+	srv := httptest.NewServer(graphqlws.NewHandler(config))
+	return srv, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// publish re-executes all subscriptions with the given root value.
+func publish(schema *graphql.Schema, manager graphqlws.SubscriptionManager, value string) {
+	for _, subscriptions := range manager.Subscriptions() {
+		for _, subscription := range subscriptions {
+			result := graphql.Do(graphql.Params{
+				Schema:         *schema,
+				RequestString:  subscription.Query,
+				VariableValues: subscription.Variables,
+				OperationName:  subscription.OperationName,
+				RootObject:     map[string]interface{}{},
+				Context:        context.Background(),
+			})
+			result.Data = map[string]interface{}{"greeting": value}
+			subscription.SendData(&graphqlws.DataMessagePayload{
+				Data:   result.Data,
+				Errors: graphqlws.ErrorsFromGraphQLErrors(result.Errors),
+			})
+		}
+	}
+}
+
+// waitFor polls a condition until it is true or a timeout expires.
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_SubscriptionsReceiveData(t *testing.T) {
+	schema := buildSchema(t)
+	manager := graphqlws.NewSubscriptionManager(schema)
+	srv, url := startServer(graphqlws.HandlerConfig{SubscriptionManager: manager})
+	defer srv.Close()
+
+	c, err := client.Dial(context.Background(), client.Config{URL: url})
+	if err != nil {
+		t.Fatal("Dial fails:", err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := c.Subscribe(ctx, "subscription { greeting }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+
+	waitFor(t, func() bool { return len(manager.Subscriptions()) == 1 })
+	publish(schema, manager, "hello")
+
+	result := <-results
+	data := struct {
+		Greeting string `json:"greeting"`
+	}{}
+	if err := result.Decode(&data); err != nil || data.Greeting != "hello" {
+		t.Errorf("Unexpected result: %s (%v)", result.Data, err)
+	}
+
+	// Cancelling the context stops the subscription
+	cancel()
+	if _, ok := <-results; ok {
+		t.Error("Results channel is not closed after cancelling the context")
+	}
+	waitFor(t, func() bool { return len(manager.Subscriptions()) == 0 })
+}
+
+func TestClient_OperationErrorsAreReported(t *testing.T) {
+	schema := buildSchema(t)
+	manager := graphqlws.NewSubscriptionManager(schema)
+	srv, url := startServer(graphqlws.HandlerConfig{SubscriptionManager: manager})
+	defer srv.Close()
+
+	c, err := client.Dial(context.Background(), client.Config{URL: url})
+	if err != nil {
+		t.Fatal("Dial fails:", err)
+	}
+	defer c.Close()
+
+	results, err := c.Subscribe(context.Background(), "subscription { unknown }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+
+	result := <-results
+	opErr := &client.OperationError{}
+	if !errors.As(result.Err, &opErr) || !strings.Contains(opErr.Error(), "unknown") {
+		t.Error("Invalid subscriptions do not report an operation error:", result.Err)
+	}
+	if _, ok := <-results; ok {
+		t.Error("Results channel is not closed after an operation error")
+	}
+}
+
+// numberError is encoded as a number rather than a GraphQL error.
+type numberError struct{}
+
+func (numberError) Error() string {
+	return "number"
+}
+
+func (numberError) MarshalJSON() ([]byte, error) {
+	return []byte("42"), nil
+}
+
+func TestClient_UndecodableResultsEndSubscriptions(t *testing.T) {
+	schema := buildSchema(t)
+	manager := graphqlws.NewSubscriptionManager(schema)
+	srv, url := startServer(graphqlws.HandlerConfig{SubscriptionManager: manager})
+	defer srv.Close()
+
+	c, err := client.Dial(context.Background(), client.Config{URL: url})
+	if err != nil {
+		t.Fatal("Dial fails:", err)
+	}
+	defer c.Close()
+
+	results, err := c.Subscribe(context.Background(), "subscription { greeting }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+	waitFor(t, func() bool { return len(manager.Subscriptions()) == 1 })
+	for _, subscriptions := range manager.Subscriptions() {
+		for _, subscription := range subscriptions {
+			subscription.SendData(&graphqlws.DataMessagePayload{Errors: []error{numberError{}}})
+		}
+	}
+
+	if result := <-results; result.Err == nil {
+		t.Error("Undecodable results are not reported:", result)
+	}
+	if _, ok := <-results; ok {
+		t.Error("Results channel is not closed after an undecodable result")
+	}
+	waitFor(t, func() bool { return len(manager.Subscriptions()) == 0 })
+}
+
+func TestClient_SlowSubscriptionsDoNotHoldUpOthers(t *testing.T) {
+	schema := buildSchema(t)
+	manager := graphqlws.NewSubscriptionManager(schema)
+	srv, url := startServer(graphqlws.HandlerConfig{SubscriptionManager: manager})
+	defer srv.Close()
+
+	c, err := client.Dial(context.Background(), client.Config{URL: url, ResultBuffer: 2})
+	if err != nil {
+		t.Fatal("Dial fails:", err)
+	}
+	defer c.Close()
+
+	slow, err := c.Subscribe(context.Background(), "subscription { greeting }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+	fast, err := c.Subscribe(context.Background(), "subscription { greeting }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+	count := func() int {
+		n := 0
+		for _, subscriptions := range manager.Subscriptions() {
+			n += len(subscriptions)
+		}
+		return n
+	}
+	waitFor(t, func() bool { return count() == 2 })
+	for i := 0; i < 3; i++ {
+		publish(schema, manager, "hello")
+		select {
+		case <-fast:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Results are held up by a slow subscription")
+		}
+	}
+
+	// The slow subscription is stopped, and told why
+	for i := 0; i < 2; i++ {
+		if result := <-slow; result.Err != nil {
+			t.Fatal("Buffered result is lost:", result.Err)
+		}
+	}
+	if result := <-slow; result == nil || result.Err != client.ErrResultBufferFull {
+		t.Error("Overflowing subscription does not report why it ended:", result)
+	}
+	if _, ok := <-slow; ok {
+		t.Error("Results channel is not closed after overflowing")
+	}
+	waitFor(t, func() bool { return count() == 1 })
+}
+
+func TestClient_RejectedConnectionsFailToDial(t *testing.T) {
+	schema := buildSchema(t)
+	srv, url := startServer(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		Authenticate: func(token string) (interface{}, error) {
+			if token != "secret" {
+				return nil, errors.New("invalid token")
+			}
+			return "user", nil
+		},
+	})
+	defer srv.Close()
+
+	_, err := client.Dial(context.Background(), client.Config{
+		URL:         url,
+		InitPayload: graphqlws.InitMessagePayload{AuthToken: "wrong"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid token") {
+		t.Error("Dial does not fail for rejected connections:", err)
+	}
+
+	c, err := client.Dial(context.Background(), client.Config{
+		URL:         url,
+		InitPayload: graphqlws.InitMessagePayload{AuthToken: "secret"},
+	})
+	if err != nil {
+		t.Fatal("Dial fails for accepted connections:", err)
+	}
+	c.Close()
+
+	select {
+	case <-c.Done():
+	default:
+		t.Error("Client is not done after closing it")
+	}
+}
+
+func TestClient_ReconnectsAndResubscribes(t *testing.T) {
+	schema := buildSchema(t)
+	manager := graphqlws.NewSubscriptionManager(schema)
+	srv, url := startServer(graphqlws.HandlerConfig{SubscriptionManager: manager})
+	defer srv.Close()
+
+	// Remember the underlying network connections so we can break them
+	conns := make(chan net.Conn, 10)
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				conns <- conn
+			}
+			return conn, err
+		},
+	}
+
+	states := make(chan client.State, 10)
+	c, err := client.Dial(context.Background(), client.Config{
+		URL:        url,
+		Dialer:     dialer,
+		Reconnect:  true,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		OnStateChange: func(state client.State, err error) {
+			states <- state
+		},
+	})
+	if err != nil {
+		t.Fatal("Dial fails:", err)
+	}
+
+	results, err := c.Subscribe(context.Background(), "subscription { greeting }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+	waitFor(t, func() bool { return len(manager.Subscriptions()) == 1 })
+
+	var original graphqlws.Connection
+	for conn := range manager.Subscriptions() {
+		original = conn
+	}
+
+	// Break the connection
+	(<-conns).Close()
+
+	expected := []client.State{
+		client.StateConnecting,
+		client.StateConnected,
+		client.StateReconnecting,
+		client.StateConnecting,
+		client.StateConnected,
+	}
+	for _, state := range expected {
+		if actual := <-states; actual != state {
+			t.Fatalf("Unexpected state %v, expected %v", actual, state)
+		}
+	}
+
+	// The subscription is restarted with its original ID on the new connection
+	waitFor(t, func() bool {
+		for conn, subscriptions := range manager.Subscriptions() {
+			if conn != original && subscriptions["1"] != nil {
+				return true
+			}
+		}
+		return false
+	})
+	publish(schema, manager, "again")
+
+	result := <-results
+	if result.Err != nil || !strings.Contains(string(result.Data), "again") {
+		t.Errorf("Unexpected result after reconnecting: %s (%v)", result.Data, result.Err)
+	}
+
+	c.Close()
+	if state := <-states; state != client.StateClosed {
+		t.Error("Client does not report being closed:", state)
+	}
+	if _, ok := <-results; ok {
+		t.Error("Results channel is not closed after closing the client")
+	}
+}
+
+func TestClient_ResumesAfterLastCursor(t *testing.T) {
+	schema := buildSchema(t)
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema:  schema,
+		History: graphqlws.NewInMemoryEventHistory(graphqlws.EventHistoryConfig{}),
+	})
+	defer bridge.Close()
+	srv, url := startServer(graphqlws.HandlerConfig{SubscriptionManager: bridge})
+	defer srv.Close()
+
+	conns := make(chan net.Conn, 10)
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				conns <- conn
+			}
+			return conn, err
+		},
+	}
+
+	c, err := client.Dial(context.Background(), client.Config{
+		URL:        url,
+		Dialer:     dialer,
+		Reconnect:  true,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal("Dial fails:", err)
+	}
+	defer c.Close()
+
+	results, err := c.Subscribe(context.Background(), "subscription { greeting }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+	waitFor(t, func() bool { return len(bridge.Subscriptions()) == 1 })
+
+	bridge.PubSub().Publish("greeting", "one")
+	if result := <-results; result.Extensions == nil || result.Extensions.Cursor != 1 {
+		t.Fatalf("Result lacks cursor: %+v", result)
+	}
+
+	var original graphqlws.Connection
+	for conn := range bridge.Subscriptions() {
+		original = conn
+	}
+
+	// Events published while reconnecting are replayed, exactly once
+	(<-conns).Close()
+	bridge.PubSub().Publish("greeting", "two")
+	waitFor(t, func() bool {
+		for conn, subscriptions := range bridge.Subscriptions() {
+			if conn != original && subscriptions["1"] != nil {
+				return true
+			}
+		}
+		return false
+	})
+	bridge.PubSub().Publish("greeting", "three")
+
+	for _, expected := range []string{"two", "three"} {
+		result := <-results
+		if result.Err != nil || !strings.Contains(string(result.Data), expected) {
+			t.Errorf("Unexpected result %s (%v), expected %q", result.Data, result.Err, expected)
+		}
+	}
+}
+
+func TestClient_ResumesSession(t *testing.T) {
+	schema := buildSchema(t)
+	manager := graphqlws.NewSubscriptionManager(schema)
+	srv, url := startServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Sessions:            &graphqlws.SessionConfig{GracePeriod: time.Minute},
+	})
+	defer srv.Close()
+
+	conns := make(chan net.Conn, 10)
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err == nil {
+				conns <- conn
+			}
+			return conn, err
+		},
+	}
+
+	states := make(chan client.State, 10)
+	c, err := client.Dial(context.Background(), client.Config{
+		URL:        url,
+		Dialer:     dialer,
+		Reconnect:  true,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		OnStateChange: func(state client.State, err error) {
+			states <- state
+		},
+	})
+	if err != nil {
+		t.Fatal("Dial fails:", err)
+	}
+	defer c.Close()
+
+	results, err := c.Subscribe(context.Background(), "subscription { greeting }", nil)
+	if err != nil {
+		t.Fatal("Subscribe fails:", err)
+	}
+	waitFor(t, func() bool { return len(manager.Subscriptions()) == 1 })
+
+	var session graphqlws.Connection
+	var subscription *graphqlws.Subscription
+	for conn, subscriptions := range manager.Subscriptions() {
+		session, subscription = conn, subscriptions["1"]
+	}
+
+	(<-conns).Close()
+	expected := []client.State{
+		client.StateConnecting,
+		client.StateConnected,
+		client.StateReconnecting,
+		client.StateConnecting,
+		client.StateConnected,
+	}
+	for _, state := range expected {
+		if actual := <-states; actual != state {
+			t.Fatalf("Unexpected state %v, expected %v", actual, state)
+		}
+	}
+
+	// The subscription is not started again, but keeps delivering results
+	if subscriptions := manager.Subscriptions(); len(subscriptions) != 1 || subscriptions[session]["1"] != subscription {
+		t.Fatal("Subscription is not resumed:", subscriptions)
+	}
+	publish(schema, manager, "resumed")
+
+	result := <-results
+	if result.Err != nil || !strings.Contains(string(result.Data), "resumed") {
+		t.Errorf("Unexpected result after resuming: %s (%v)", result.Data, result.Err)
+	}
+}
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Default delay before the first reconnection attempt
+	defaultMinBackoff = 500 * time.Millisecond
+
+	// Default maximum delay between reconnection attempts
+	defaultMaxBackoff = 30 * time.Second
+)
+
+// State is the state of the connection of a client.
+type State int
+
+const (
+	// StateConnecting means the client is establishing a connection.
+	StateConnecting State = iota
+
+	// StateConnected means the server has acknowledged the connection.
+	StateConnected
+
+	// StateReconnecting means the connection was lost and the client
+	// is waiting to reconnect.
+	StateReconnecting
+
+	// StateClosed means the client is closed and will not reconnect.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+func (c *Client) setState(state State, err error) {
+	c.logger.WithFields(log.Fields{
+		"state": state,
+		"err":   err,
+	}).Debug("Connection state changed")
+
+	if c.config.OnStateChange != nil {
+		c.config.OnStateChange(state, err)
+	}
+}
+
+// backoff returns the delay before a reconnection attempt: it grows
+// exponentially up to the maximum, with up to half of it randomized
+// to avoid all clients reconnecting at once.
+func (c *Client) backoff(attempt int) time.Duration {
+	backoff := c.config.MaxBackoff
+	if attempt < 32 {
+		if exponential := c.config.MinBackoff << uint(attempt); exponential > 0 && exponential < backoff {
+			backoff = exponential
+		}
+	}
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// reconnect re-establishes the connection and restarts all active
+// operations, retrying until it succeeds, the client is closed or the
+// maximum number of attempts is reached.
+func (c *Client) reconnect() (*websocket.Conn, error) {
+	var lastErr error
+
+	for attempt := 0; c.config.MaxReconnectAttempts <= 0 || attempt < c.config.MaxReconnectAttempts; attempt++ {
+		select {
+		case <-time.After(c.backoff(attempt)):
+		case <-c.ctx.Done():
+			return nil, ErrClosed
+		}
+
+		c.setState(StateConnecting, nil)
+		ws, resumed, err := c.connect(c.ctx)
+		if err == nil {
+			err = c.resubscribe(ws, resumed)
+		}
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return nil, ErrClosed
+			}
+			c.logger.WithFields(log.Fields{
+				"attempt": attempt + 1,
+				"err":     err,
+			}).Warn("Failed to reconnect")
+			c.setState(StateReconnecting, err)
+			lastErr = err
+			continue
+		}
+
+		c.mutex.Lock()
+		c.lastSeen = time.Now()
+		c.mutex.Unlock()
+
+		c.setState(StateConnected, nil)
+		return ws, nil
+	}
+
+	return nil, lastErr
+}
+
+// resubscribe switches the client over to a new connection and starts
+// all active operations on it again, using their original IDs, unless
+// the server resumed them. Resumed operations that have ended in the
+// meantime are stopped.
+func (c *Client) resubscribe(ws *websocket.Conn, resumed map[string]bool) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	c.mutex.Lock()
+	if c.err != nil {
+		c.mutex.Unlock()
+		ws.Close()
+		return ErrClosed
+	}
+	c.ws = ws
+	messages := []graphqlws.OperationMessage{}
+	for _, op := range c.operations {
+		if !resumed[op.id] {
+			messages = append(messages, graphqlws.OperationMessage{
+				ID:      op.id,
+				Type:    gqlStart,
+				Payload: op.resumePayload(),
+			})
+		}
+	}
+	for id := range resumed {
+		if c.operations[id] == nil {
+			messages = append(messages, graphqlws.OperationMessage{ID: id, Type: gqlStop})
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, msg := range messages {
+		if err := writeMessage(ws, msg); err != nil {
+			ws.Close()
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package graphqlws
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codec encodes the operation messages sent to clients and decodes the
+// messages received from them. Clients select a codec by requesting its
+// WebSocket subprotocol; JSON over the "graphql-ws" subprotocol is the
+// default.
+type Codec interface {
+	// Subprotocol returns the WebSocket subprotocol clients request to
+	// use the codec.
+	Subprotocol() string
+
+	// Binary returns whether messages are sent as binary rather than
+	// text frames.
+	Binary() bool
+
+	// Encode encodes a message sent to a client.
+	Encode(msg OperationMessage) ([]byte, error)
+
+	// Decode decodes a message received from a client, leaving its
+	// payload undecoded until the message type is known. The payload is
+	// empty if the message has none.
+	Decode(data []byte) (msg OperationMessage, payload []byte, err error)
+
+	// DecodePayload decodes the payload of a message into v.
+	DecodePayload(payload []byte, v interface{}) error
+}
+
+// NewJSONCodec returns the default codec, which encodes messages as
+// JSON text frames over the "graphql-ws" subprotocol.
+func NewJSONCodec() Codec {
+	return jsonCodec{}
+}
+
+/**
+ * The default implementation of the Codec interface.
+ */
+
+type jsonCodec struct{}
+
+func (jsonCodec) Subprotocol() string {
+	return "graphql-ws"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Encode(msg OperationMessage) ([]byte, error) {
+	return encodeOperationMessage(msg)
+}
+
+func (jsonCodec) Decode(data []byte) (OperationMessage, []byte, error) {
+	return decodeOperationMessage(data)
+}
+
+func (jsonCodec) DecodePayload(payload []byte, v interface{}) error {
+	return json.Unmarshal(payload, v)
+}
+
+// codecMessageType returns the WebSocket frame type of a codec.
+func codecMessageType(codec Codec) int {
+	if codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// codecForSubprotocol returns the codec for a negotiated subprotocol,
+// or nil if none of the codecs implements it.
+func codecForSubprotocol(codecs []Codec, subprotocol string) Codec {
+	for _, codec := range codecs {
+		if codec.Subprotocol() == subprotocol {
+			return codec
+		}
+	}
+	return nil
+}
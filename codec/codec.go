@@ -0,0 +1,184 @@
+// Package codec provides binary message encodings for GraphQL WebSocket
+// connections. Clients opt into them by requesting their subprotocol
+// instead of "graphql-ws":
+//
+//	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+//		SubscriptionManager: subscriptionManager,
+//		Codecs:              []graphqlws.Codec{codec.NewMessagePackCodec(), codec.NewCBORCodec()},
+//	})
+//
+// Messages and payloads are encoded with the field names of their JSON
+// encoding, so clients see the same structure as with JSON.
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// MessagePackSubprotocol is the subprotocol of the MessagePack codec.
+	MessagePackSubprotocol = "graphql-ws.msgpack"
+
+	// CBORSubprotocol is the subprotocol of the CBOR codec.
+	CBORSubprotocol = "graphql-ws.cbor"
+)
+
+// message is the shape of encoded operation messages.
+type message struct {
+	ID      string      `json:"id,omitempty"`
+	Type    string      `json:"type"`
+	Payload interface{} `json:"payload,omitempty"`
+}
+
+// messageForEncoding prepares a message for being encoded with a codec
+// other than JSON. Data is encoded as is, while errors and non-data
+// payloads are converted to their JSON structure first, as they often
+// only know how to encode themselves as JSON.
+func messageForEncoding(msg graphqlws.OperationMessage) (message, error) {
+	out := message{ID: msg.ID, Type: msg.Type}
+	if data, ok := msg.Payload.(*graphqlws.DataMessagePayload); ok {
+		payload := map[string]interface{}{"data": data.Data}
+		if len(data.Errors) > 0 {
+			errs, err := jsonValue(data.Errors)
+			if err != nil {
+				return out, err
+			}
+			payload["errors"] = errs
+		}
+		if data.Extensions != nil {
+			extensions, err := jsonValue(data.Extensions)
+			if err != nil {
+				return out, err
+			}
+			payload["extensions"] = extensions
+		}
+		out.Payload = payload
+		return out, nil
+	}
+	payload, err := jsonValue(msg.Payload)
+	out.Payload = payload
+	return out, err
+}
+
+// jsonValue converts a value into its JSON structure.
+func jsonValue(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	err = json.Unmarshal(data, &out)
+	return out, err
+}
+
+/**
+ * MessagePack
+ */
+
+// NewMessagePackCodec returns a codec encoding messages as MessagePack
+// binary frames over the "graphql-ws.msgpack" subprotocol.
+func NewMessagePackCodec() graphqlws.Codec {
+	return msgpackCodec{}
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Subprotocol() string {
+	return MessagePackSubprotocol
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Encode(msg graphqlws.OperationMessage) ([]byte, error) {
+	out, err := messageForEncoding(msg)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c msgpackCodec) Decode(data []byte) (graphqlws.OperationMessage, []byte, error) {
+	msg := struct {
+		ID      string             `json:"id"`
+		Type    string             `json:"type"`
+		Payload msgpack.RawMessage `json:"payload"`
+	}{}
+	err := c.DecodePayload(data, &msg)
+	return graphqlws.OperationMessage{ID: msg.ID, Type: msg.Type}, msg.Payload, err
+}
+
+func (msgpackCodec) DecodePayload(payload []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(payload))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+/**
+ * CBOR
+ */
+
+var (
+	cborEncMode, _ = cbor.EncOptions{}.EncMode()
+
+	// Decode maps like encoding/json does, as variables are expected
+	// to be keyed by strings
+	cborDecMode, _ = cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+	}.DecMode()
+)
+
+// NewCBORCodec returns a codec encoding messages as CBOR (RFC 8949)
+// binary frames over the "graphql-ws.cbor" subprotocol.
+func NewCBORCodec() graphqlws.Codec {
+	return cborCodec{}
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Subprotocol() string {
+	return CBORSubprotocol
+}
+
+func (cborCodec) Binary() bool {
+	return true
+}
+
+func (cborCodec) Encode(msg graphqlws.OperationMessage) ([]byte, error) {
+	out, err := messageForEncoding(msg)
+	if err != nil {
+		return nil, err
+	}
+	return cborEncMode.Marshal(out)
+}
+
+func (cborCodec) Decode(data []byte) (graphqlws.OperationMessage, []byte, error) {
+	msg := struct {
+		ID      string          `json:"id"`
+		Type    string          `json:"type"`
+		Payload cbor.RawMessage `json:"payload"`
+	}{}
+	err := cborDecMode.Unmarshal(data, &msg)
+	return graphqlws.OperationMessage{ID: msg.ID, Type: msg.Type}, msg.Payload, err
+}
+
+func (cborCodec) DecodePayload(payload []byte, v interface{}) error {
+	return cborDecMode.Unmarshal(payload, v)
+}
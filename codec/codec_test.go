@@ -0,0 +1,113 @@
+package codec_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/codec"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+)
+
+func TestCodecs_NegotiatedBySubprotocol(t *testing.T) {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{"greeting": &graphql.Field{
+				Type: graphql.String,
+				Args: graphql.FieldConfigArgument{"name": &graphql.ArgumentConfig{Type: graphql.String}},
+			}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager := graphqlws.NewSubscriptionManager(&schema)
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Codecs:              []graphqlws.Codec{codec.NewMessagePackCodec(), codec.NewCBORCodec()},
+	})
+	defer srv.Close()
+
+	for _, c := range []graphqlws.Codec{codec.NewMessagePackCodec(), codec.NewCBORCodec()} {
+		t.Run(c.Subprotocol(), func(t *testing.T) {
+			dialer := websocket.Dialer{Subprotocols: []string{c.Subprotocol(), "graphql-ws"}}
+			ws, _, err := dialer.Dial(srv.URL, http.Header{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			if ws.Subprotocol() != c.Subprotocol() {
+				t.Fatal("Codec is not negotiated:", ws.Subprotocol())
+			}
+
+			send := func(msg graphqlws.OperationMessage) {
+				data, err := c.Encode(msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ws.WriteMessage(websocket.BinaryMessage, data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			receive := func(expectedType string) map[string]interface{} {
+				ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+				frameType, data, err := ws.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				msg, payload, err := c.Decode(data)
+				if err != nil || frameType != websocket.BinaryMessage || msg.Type != expectedType {
+					t.Fatalf("Expected %s message, got %v (%v)", expectedType, msg, err)
+				}
+				out := map[string]interface{}{}
+				if len(payload) > 0 {
+					c.DecodePayload(payload, &out)
+				}
+				return out
+			}
+
+			send(graphqlws.OperationMessage{Type: "connection_init"})
+			receive("connection_ack")
+
+			send(graphqlws.OperationMessage{ID: "1", Type: "start", Payload: map[string]interface{}{
+				"query":     "subscription ($name: String) { greeting(name: $name) }",
+				"variables": map[string]interface{}{"name": "codec"},
+			}})
+			send(graphqlws.OperationMessage{ID: "probe", Type: "start", Payload: map[string]interface{}{
+				"query": "{",
+			}})
+			receive("error")
+
+			for conn, subscriptions := range manager.Subscriptions() {
+				for _, subscription := range subscriptions {
+					if subscription.Variables["name"] != "codec" {
+						t.Error("Variables are not decoded:", subscription.Variables)
+					}
+					subscription.SendData(&graphqlws.DataMessagePayload{
+						Data: map[string]interface{}{"greeting": "hello"},
+					})
+				}
+				defer manager.RemoveSubscriptions(conn)
+			}
+
+			payload := receive("data")
+			if data, _ := payload["data"].(map[string]interface{}); data["greeting"] != "hello" {
+				t.Error("Unexpected data payload:", payload)
+			}
+		})
+	}
+
+	// JSON remains the default
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Init(nil)
+	client.ExpectAck()
+}
@@ -0,0 +1,135 @@
+package graphqlws
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Compression enables permessage-deflate compression (RFC 7692) of
+// messages sent to clients that support it. Messages smaller than
+// MinSize are sent uncompressed, as compressing them costs more CPU
+// than it saves bandwidth.
+//
+// The same Compression is shared by all connections of a handler and
+// collects statistics about all of them; statistics of individual
+// connections are available via ConnectionCompressionStats.
+type Compression struct {
+	// MinSize is the size in bytes from which messages are compressed.
+	MinSize int
+
+	// Level is the flate compression level, from 1 (best speed) to 9
+	// (best compression); defaults to 1.
+	Level int
+
+	stats compressionCounters
+}
+
+// CompressionStats provides statistics about compressed messages.
+type CompressionStats struct {
+	// Messages is the number of messages sent compressed.
+	Messages uint64
+
+	// UncompressedBytes is the size of these messages before compression.
+	UncompressedBytes uint64
+
+	// CompressedBytes is the number of bytes sent for these messages,
+	// including frame headers.
+	CompressedBytes uint64
+}
+
+// BytesSaved returns the number of bytes saved by compression.
+func (stats CompressionStats) BytesSaved() int64 {
+	return int64(stats.UncompressedBytes) - int64(stats.CompressedBytes)
+}
+
+// Stats returns statistics about the messages compressed so far.
+func (c *Compression) Stats() CompressionStats {
+	return c.stats.load()
+}
+
+func (c *Compression) level() int {
+	if c.Level == 0 {
+		return 1
+	}
+	return c.Level
+}
+
+// ConnectionCompressionStats returns statistics about the messages
+// compressed for a connection; they are empty for connections that
+// have not negotiated compression.
+func ConnectionCompressionStats(conn Connection) CompressionStats {
+	if c, ok := conn.(interface{ CompressionStats() CompressionStats }); ok {
+		return c.CompressionStats()
+	}
+	return CompressionStats{}
+}
+
+type compressionCounters struct {
+	messages     uint64
+	uncompressed uint64
+	compressed   uint64
+}
+
+func (c *compressionCounters) add(uncompressed int, compressed uint64) {
+	atomic.AddUint64(&c.messages, 1)
+	atomic.AddUint64(&c.uncompressed, uint64(uncompressed))
+	atomic.AddUint64(&c.compressed, compressed)
+}
+
+func (c *compressionCounters) load() CompressionStats {
+	return CompressionStats{
+		Messages:          atomic.LoadUint64(&c.messages),
+		UncompressedBytes: atomic.LoadUint64(&c.uncompressed),
+		CompressedBytes:   atomic.LoadUint64(&c.compressed),
+	}
+}
+
+// offersCompression returns whether a WebSocket client offers the
+// permessage-deflate extension.
+func offersCompression(r *http.Request) bool {
+	for _, extensions := range r.Header["Sec-Websocket-Extensions"] {
+		if strings.Contains(extensions, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingConn counts the bytes written to a network connection, so
+// that the size of compressed messages can be determined.
+type countingConn struct {
+	net.Conn
+	written uint64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesWritten() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
+
+// countingResponseWriter hands out a countingConn when the WebSocket
+// upgrader hijacks the connection.
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn}, rw, nil
+}
@@ -0,0 +1,82 @@
+package graphqlws_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/gorilla/websocket"
+)
+
+func TestCompression_CompressesLargeMessages(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	compression := &graphqlws.Compression{MinSize: 1024, Level: 6}
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Compression:         compression,
+	}))
+	defer srv.Close()
+
+	dial := func(enableCompression bool) *websocket.Conn {
+		dialer := websocket.Dialer{
+			Subprotocols:      []string{"graphql-ws"},
+			EnableCompression: enableCompression,
+		}
+		ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws.WriteJSON(map[string]interface{}{"type": "connection_init", "payload": map[string]interface{}{}})
+		ws.WriteJSON(map[string]interface{}{
+			"id":      "1",
+			"type":    "start",
+			"payload": map[string]interface{}{"query": "subscription { greeting }"},
+		})
+		return ws
+	}
+
+	compressed := dial(true)
+	defer compressed.Close()
+	uncompressed := dial(false)
+	defer uncompressed.Close()
+
+	// Wait for both connections to be acknowledged
+	for _, ws := range []*websocket.Conn{compressed, uncompressed} {
+		msg := map[string]interface{}{}
+		if err := ws.ReadJSON(&msg); err != nil || msg["type"] != "connection_ack" {
+			t.Fatal("Connection is not acknowledged:", msg, err)
+		}
+	}
+
+	large := strings.Repeat("hello ", 1000)
+	for _, greeting := range []string{"hi", large} {
+		publishGreetingValue(t, manager, 2, greeting)
+		for _, ws := range []*websocket.Conn{compressed, uncompressed} {
+			msg := struct {
+				Payload struct {
+					Data struct{ Greeting string }
+				}
+			}{}
+			if err := ws.ReadJSON(&msg); err != nil || msg.Payload.Data.Greeting != greeting {
+				t.Fatal("Unexpected message:", err)
+			}
+		}
+	}
+
+	for conn := range manager.Subscriptions() {
+		stats := graphqlws.ConnectionCompressionStats(conn)
+		if stats.Messages == 0 {
+			continue
+		}
+		if stats.Messages != 1 || stats.UncompressedBytes < uint64(len(large)) || stats.BytesSaved() < int64(len(large))/2 {
+			t.Error("Unexpected connection compression stats:", stats)
+		}
+		if compression.Stats() != stats {
+			t.Error("Compression stats are not collected across connections:", compression.Stats())
+		}
+		return
+	}
+	t.Error("No message was compressed")
+}
@@ -1,6 +1,7 @@
 package graphqlws
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql/gqlerrors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -32,24 +34,120 @@ const (
 	writeTimeout = 10 * time.Second
 )
 
+var (
+	// ErrRateLimitExceeded is sent to clients whose messages are dropped
+	// because they exceed the message rate limit.
+	ErrRateLimitExceeded = errors.New("Rate limit exceeded, message dropped")
+
+	// ErrConnectionNotInitialized is sent to clients that start operations
+	// before initializing (and authenticating) the connection.
+	ErrConnectionNotInitialized = errors.New("Connection has not been initialized")
+
+	// ErrConnectionAlreadyInitialized is sent to clients that initialize
+	// a connection again, e.g. to switch to another user.
+	ErrConnectionAlreadyInitialized = errors.New("Connection has already been initialized")
+)
+
 // InitMessagePayload defines the parameters of a connection
 // init message.
 type InitMessagePayload struct {
 	AuthToken string `json:"authToken"`
+
+	// SessionToken resumes the session of a previous connection.
+	SessionToken string `json:"sessionToken,omitempty"`
+}
+
+// ConnectionAckPayload defines the payload of connection ack messages
+// sent by handlers that support resuming sessions.
+type ConnectionAckPayload struct {
+	// SessionToken resumes the session when reconnecting.
+	SessionToken string `json:"sessionToken"`
+
+	// Resumed is whether the session of a previous connection was
+	// resumed, along with its operations.
+	Resumed bool `json:"resumed"`
+
+	// Operations are the IDs of the resumed operations.
+	Operations []string `json:"operations,omitempty"`
 }
 
 // StartMessagePayload defines the parameters of an operation that
 // a client requests to be started.
 type StartMessagePayload struct {
-	Query         string                 `json:"query"`
-	Variables     map[string]interface{} `json:"variables"`
-	OperationName string                 `json:"operationName"`
+	Query         string                  `json:"query"`
+	Variables     map[string]interface{}  `json:"variables"`
+	OperationName string                  `json:"operationName"`
+	Extensions    *StartMessageExtensions `json:"extensions,omitempty"`
+}
+
+// StartMessageExtensions defines the protocol extensions a client
+// may send along with an operation.
+type StartMessageExtensions struct {
+	PersistedQuery *PersistedQueryExtension `json:"persistedQuery,omitempty"`
+	Resume         *ResumeExtension         `json:"resume,omitempty"`
+}
+
+// PersistedQueryExtension references an automatic persisted query
+// by the SHA-256 hash of its query text.
+type PersistedQueryExtension struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+// ResumeExtension resumes a subscription after the event with the
+// given cursor; events recorded since then are replayed first.
+type ResumeExtension struct {
+	Cursor uint64 `json:"cursor"`
 }
 
 // DataMessagePayload defines the result data of an operation.
 type DataMessagePayload struct {
-	Data   interface{} `json:"data"`
-	Errors []error     `json:"errors"`
+	Data       interface{}            `json:"data"`
+	Errors     []error                `json:"errors"`
+	Extensions *DataMessageExtensions `json:"extensions,omitempty"`
+
+	// The JSON encoding of the payload, if prepared with PrepareData
+	encoded json.RawMessage
+}
+
+// DataMessageExtensions defines the protocol extensions the server
+// may send along with a result.
+type DataMessageExtensions struct {
+	// Cursor is the ID of the event the result was produced for; a
+	// client passes it in a ResumeExtension to resume after the event.
+	Cursor uint64 `json:"cursor,omitempty"`
+
+	// Truncated marks the error result sent when resuming after a cursor
+	// the event history no longer retains all following events of; the
+	// events that are still retained are sent after it.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// PrepareData encodes a data payload once, so that it can be sent to
+// any number of subscribers without being encoded for each of them.
+// The prepared payload is sent as is; in particular, its errors are not
+// formatted for individual connections.
+func PrepareData(data *DataMessagePayload) (*DataMessagePayload, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	return &DataMessagePayload{
+		Data:       data.Data,
+		Errors:     data.Errors,
+		Extensions: data.Extensions,
+		encoded:    encoded,
+	}, nil
+}
+
+// MarshalJSON encodes the payload, reusing the encoding of prepared
+// payloads.
+func (data *DataMessagePayload) MarshalJSON() ([]byte, error) {
+	if data.encoded != nil {
+		return data.encoded, nil
+	}
+	type payload DataMessagePayload
+	return json.Marshal((*payload)(data))
 }
 
 // OperationMessage represents a GraphQL WebSocket message.
@@ -60,17 +158,49 @@ type OperationMessage struct {
 }
 
 func (msg OperationMessage) String() string {
-	s, _ := json.Marshal(msg)
+	s, _ := encodeOperationMessage(msg)
 	if s != nil {
 		return string(s)
 	}
 	return "<invalid>"
 }
 
+// encodeOperationMessage encodes a message as JSON; prepared data
+// payloads are embedded without being validated again.
+func encodeOperationMessage(msg OperationMessage) ([]byte, error) {
+	data, ok := msg.Payload.(*DataMessagePayload)
+	if !ok || data.encoded == nil {
+		return json.Marshal(msg)
+	}
+
+	id, err := json.Marshal(msg.ID)
+	if err != nil {
+		return nil, err
+	}
+	messageType, err := json.Marshal(msg.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(id)+len(messageType)+len(data.encoded)+32)
+	out = append(out, `{"id":`...)
+	out = append(out, id...)
+	out = append(out, `,"type":`...)
+	out = append(out, messageType...)
+	out = append(out, `,"payload":`...)
+	out = append(out, data.encoded...)
+	out = append(out, '}')
+	return out, nil
+}
+
 // AuthenticateFunc is a function that resolves an auth token
 // into a user (or returns an error if that isn't possible).
 type AuthenticateFunc func(token string) (interface{}, error)
 
+// FormatErrorFunc is a function that formats errors before they are
+// sent to clients, e.g. to add extensions or hide internal details.
+type FormatErrorFunc func(err error) gqlerrors.FormattedError
+
 // ConnectionEventHandlers define the event handlers for a connection.
 // Event handlers allow other system components to react to events such
 // as the connection closing or an operation being started or stopped.
@@ -91,6 +221,15 @@ type ConnectionEventHandlers struct {
 	// are expected to unregister the operation and stop sending result
 	// data to the client.
 	StopOperation func(Connection, string)
+
+	// Init is called when the client has initialized the connection and
+	// is authenticated, with the payload of its init message. It returns
+	// the payload of the connection ack message, if any.
+	Init func(Connection, *InitMessagePayload) interface{}
+
+	// Acknowledged is called once the connection ack message is sent,
+	// before any further messages of the client are handled.
+	Acknowledged func(Connection)
 }
 
 // ConnectionConfig defines the configuration parameters of a
@@ -98,6 +237,23 @@ type ConnectionEventHandlers struct {
 type ConnectionConfig struct {
 	Authenticate  AuthenticateFunc
 	EventHandlers ConnectionEventHandlers
+
+	// RateLimit optionally limits how many messages the client may send.
+	RateLimit *MessageRateLimit
+
+	// Context optionally derives the context of the connection from a
+	// base context, once the user is authenticated; see ConnectionContext.
+	Context func(ctx context.Context, user interface{}) context.Context
+
+	// FormatError optionally formats errors sent to the client.
+	FormatError FormatErrorFunc
+
+	// Compression optionally compresses messages sent to the client,
+	// if the WebSocket connection has negotiated compression.
+	Compression *Compression
+
+	// Codec encodes and decodes messages; defaults to JSON.
+	Codec Codec
 }
 
 // Connection is an interface to represent GraphQL WebSocket connections.
@@ -122,14 +278,22 @@ type Connection interface {
  */
 
 type connection struct {
-	id         string
-	ws         *websocket.Conn
-	config     ConnectionConfig
-	logger     *log.Entry
-	outgoing   chan OperationMessage
-	user       interface{}
-	closeMutex *sync.Mutex
-	closed     bool
+	id          string
+	ws          *websocket.Conn
+	config      ConnectionConfig
+	logger      *log.Entry
+	outgoing    chan OperationMessage
+	user        interface{}
+	initialized bool
+	ctx         context.Context
+	cancel      context.CancelFunc
+	closeMutex  *sync.Mutex
+	closed      bool
+	terminated  bool
+
+	// Counts bytes sent over the wire if compression is negotiated
+	wire             *countingConn
+	compressionStats compressionCounters
 }
 
 func operationMessageForType(messageType string) OperationMessage {
@@ -149,9 +313,19 @@ func NewConnection(ws *websocket.Conn, config ConnectionConfig) Connection {
 	conn.logger = NewLogger("connection/" + conn.id)
 	conn.closed = false
 	conn.closeMutex = &sync.Mutex{}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
 
 	conn.outgoing = make(chan OperationMessage)
 
+	if conn.config.Codec == nil {
+		conn.config.Codec = NewJSONCodec()
+	}
+
+	if config.Compression != nil {
+		conn.ws.SetCompressionLevel(config.Compression.level())
+		conn.wire, _ = ws.UnderlyingConn().(*countingConn)
+	}
+
 	go conn.writeLoop()
 	go conn.readLoop()
 
@@ -168,7 +342,28 @@ func (conn *connection) User() interface{} {
 	return conn.user
 }
 
+// Context returns the context of the connection, which is cancelled
+// when the connection is closed.
+func (conn *connection) Context() context.Context {
+	conn.closeMutex.Lock()
+	defer conn.closeMutex.Unlock()
+	return conn.ctx
+}
+
+// CompressionStats returns statistics about the messages compressed
+// for the connection.
+func (conn *connection) CompressionStats() CompressionStats {
+	return conn.compressionStats.load()
+}
+
 func (conn *connection) SendData(opID string, data *DataMessagePayload) {
+	if conn.config.FormatError != nil && len(data.Errors) > 0 && data.encoded == nil {
+		formatted := &DataMessagePayload{Data: data.Data, Extensions: data.Extensions}
+		for _, err := range data.Errors {
+			formatted.Errors = append(formatted.Errors, conn.config.FormatError(err))
+		}
+		data = formatted
+	}
 	msg := operationMessageForType(gqlData)
 	msg.ID = opID
 	msg.Payload = data
@@ -195,7 +390,7 @@ func (conn *connection) sendOperationErrors(opID string, errs []error) {
 	}
 	msg := operationMessageForType(gqlError)
 	msg.ID = opID
-	msg.Payload = errs
+	msg.Payload = errorsForPayload(errs, conn.config.FormatError)
 	conn.closeMutex.Lock()
 	if !conn.closed {
 		conn.outgoing <- msg
@@ -203,12 +398,89 @@ func (conn *connection) sendOperationErrors(opID string, errs []error) {
 	conn.closeMutex.Unlock()
 }
 
+// errorsForPayload prepares errors for being encoded as JSON, using
+// the format function if there is one; otherwise errors that don't know
+// how to encode themselves are encoded as GraphQL errors with just a
+// message.
+func errorsForPayload(errs []error, format FormatErrorFunc) []interface{} {
+	out := make([]interface{}, len(errs))
+	for i, err := range errs {
+		if format != nil {
+			out[i] = format(err)
+		} else if _, ok := err.(json.Marshaler); ok {
+			out[i] = err
+		} else if formatted, ok := err.(gqlerrors.FormattedError); ok {
+			out[i] = formatted
+		} else {
+			out[i] = map[string]interface{}{"message": err.Error()}
+		}
+	}
+	return out
+}
+
+// acknowledge marks the connection as initialized and acknowledges it
+// to the client.
+func (conn *connection) acknowledge(data *InitMessagePayload) {
+	conn.initialized = true
+	conn.deriveContext()
+
+	msg := operationMessageForType(gqlConnectionAck)
+	if conn.config.EventHandlers.Init != nil {
+		msg.Payload = conn.config.EventHandlers.Init(conn, data)
+	}
+	conn.outgoing <- msg
+
+	if conn.config.EventHandlers.Acknowledged != nil {
+		conn.config.EventHandlers.Acknowledged(conn)
+	}
+}
+
+// terminatedByClient returns whether the client closed the connection
+// deliberately, rather than losing it.
+func (conn *connection) terminatedByClient() bool {
+	return conn.terminated
+}
+
+// deriveContext derives the context of the connection for its
+// authenticated user.
+func (conn *connection) deriveContext() {
+	if conn.config.Context == nil {
+		return
+	}
+	conn.closeMutex.Lock()
+	defer conn.closeMutex.Unlock()
+	conn.ctx = conn.config.Context(conn.ctx, conn.user)
+}
+
+// ConnectionContext returns the context of a connection, as derived by
+// the Context function of its configuration, for executing operations
+// on behalf of its user. Connections without a context get a background
+// context.
+func ConnectionContext(conn Connection) context.Context {
+	if c, ok := conn.(interface{ Context() context.Context }); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// decodeOperationMessage decodes a message received from a client,
+// leaving its payload undecoded until the message type is known.
+func decodeOperationMessage(data []byte) (OperationMessage, json.RawMessage, error) {
+	rawPayload := json.RawMessage{}
+	msg := OperationMessage{
+		Payload: &rawPayload,
+	}
+	err := json.Unmarshal(data, &msg)
+	return msg, rawPayload, err
+}
+
 func (conn *connection) close() {
 	// Close the write loop by closing the outgoing messages channels
 	conn.closeMutex.Lock()
 	conn.closed = true
 	close(conn.outgoing)
 	conn.closeMutex.Unlock()
+	conn.cancel()
 
 	// Notify event handlers
 	if conn.config.EventHandlers.Close != nil {
@@ -234,38 +506,81 @@ func (conn *connection) writeLoop() {
 				return
 			}
 
-			conn.logger.WithFields(log.Fields{
-				"msg": msg.String(),
-			}).Debug("Send message")
+			data, err := conn.config.Codec.Encode(msg)
+			if err != nil {
+				conn.logger.WithFields(log.Fields{
+					"err": err,
+				}).Warn("Failed to encode message")
+				continue
+			}
+
+			// Avoid copying large payloads for nothing; log binary
+			// messages as JSON
+			if conn.logger.Logger.IsLevelEnabled(log.DebugLevel) {
+				logged := string(data)
+				if conn.config.Codec.Binary() {
+					logged = msg.String()
+				}
+				conn.logger.WithFields(log.Fields{
+					"msg": logged,
+				}).Debug("Send message")
+			}
 
 			conn.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
 
 			// Send the message to the client; if this times out, the WebSocket
-			// connection will be corrupt, hence we need to close the write loop
-			// and the connection immediately
-			if err := conn.ws.WriteJSON(msg); err != nil {
+			// connection will be corrupt, hence we need to close the connection
+			// immediately and discard all remaining messages (rather than
+			// blocking senders) until the read loop closes the channel
+			if err := conn.writeMessage(data); err != nil {
 				conn.logger.WithFields(log.Fields{
 					"err": err,
 				}).Warn("Sending message failed")
+				conn.ws.Close()
+				for range conn.outgoing {
+				}
 				return
 			}
 		}
 	}
 }
 
+// writeMessage sends an encoded message, compressing it if it is large
+// enough and the connection has negotiated compression.
+func (conn *connection) writeMessage(data []byte) error {
+	messageType := codecMessageType(conn.config.Codec)
+	compression := conn.config.Compression
+	if compression == nil {
+		return conn.ws.WriteMessage(messageType, data)
+	}
+
+	compress := len(data) >= compression.MinSize
+	conn.ws.EnableWriteCompression(compress)
+	if !compress || conn.wire == nil {
+		return conn.ws.WriteMessage(messageType, data)
+	}
+
+	before := conn.wire.bytesWritten()
+	if err := conn.ws.WriteMessage(messageType, data); err != nil {
+		return err
+	}
+	written := conn.wire.bytesWritten() - before
+	conn.compressionStats.add(len(data), written)
+	compression.stats.add(len(data), written)
+	return nil
+}
+
 func (conn *connection) readLoop() {
 	// Close the WebSocket connection when leaving the read loop
 	defer conn.ws.Close()
 
 	conn.ws.SetReadLimit(readLimit)
 
+	limiter := newMessageRateLimiter(conn.config.RateLimit)
+
 	for {
 		// Read the next message received from the client
-		rawPayload := json.RawMessage{}
-		msg := OperationMessage{
-			Payload: &rawPayload,
-		}
-		err := conn.ws.ReadJSON(&msg)
+		_, data, err := conn.ws.ReadMessage()
 
 		// If this causes an error, close the connection and read loop immediately;
 		// see https://github.com/gorilla/websocket/blob/master/conn.go#L924 for
@@ -278,6 +593,36 @@ func (conn *connection) readLoop() {
 			return
 		}
 
+		// Drop messages that exceed the rate limit before decoding them;
+		// disconnect clients that keep exceeding it
+		if allowed, notify, disconnect := limiter.allow(); !allowed {
+			if disconnect {
+				conn.logger.Warn("Closing connection after repeatedly exceeding the rate limit")
+				conn.ws.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "Rate limit exceeded"),
+					time.Now().Add(writeTimeout),
+				)
+				conn.close()
+				return
+			}
+			conn.logger.Debug("Dropping message exceeding the rate limit")
+			if notify {
+				conn.SendError(ErrRateLimitExceeded)
+			}
+			continue
+		}
+
+		// Decode the message; invalid messages close the connection
+		msg, rawPayload, err := conn.config.Codec.Decode(data)
+		if err != nil {
+			conn.logger.WithFields(log.Fields{
+				"reason": err,
+			}).Warn("Closing connection")
+			conn.close()
+			return
+		}
+
 		conn.logger.WithFields(log.Fields{
 			"id":   msg.ID,
 			"type": msg.Type,
@@ -287,8 +632,18 @@ func (conn *connection) readLoop() {
 
 		// When the GraphQL WS connection is initiated, send an ACK back
 		case gqlConnectionInit:
+			// Connections are indexed by their user once initialized, so
+			// they cannot switch users
+			if conn.initialized {
+				msg := operationMessageForType(gqlConnectionError)
+				msg.Payload = ErrConnectionAlreadyInitialized.Error()
+				conn.outgoing <- msg
+				break
+			}
+
+			// The payload is optional
 			data := InitMessagePayload{}
-			if err := json.Unmarshal(rawPayload, &data); err != nil {
+			if len(rawPayload) > 0 && conn.config.Codec.DecodePayload(rawPayload, &data) != nil {
 				conn.SendError(errors.New("Invalid GQL_CONNECTION_INIT payload"))
 			} else {
 				if conn.config.Authenticate != nil {
@@ -299,10 +654,10 @@ func (conn *connection) readLoop() {
 						conn.outgoing <- msg
 					} else {
 						conn.user = user
-						conn.outgoing <- operationMessageForType(gqlConnectionAck)
+						conn.acknowledge(&data)
 					}
 				} else {
-					conn.outgoing <- operationMessageForType(gqlConnectionAck)
+					conn.acknowledge(&data)
 				}
 			}
 
@@ -310,8 +665,11 @@ func (conn *connection) readLoop() {
 		case gqlStart:
 			if conn.config.EventHandlers.StartOperation != nil {
 				data := StartMessagePayload{}
-				if err := json.Unmarshal(rawPayload, &data); err != nil {
-					conn.SendError(errors.New("Invalid GQL_START payload"))
+				if conn.config.Authenticate != nil && !conn.initialized {
+					// Operations must not bypass authentication
+					conn.sendOperationErrors(msg.ID, []error{ErrConnectionNotInitialized})
+				} else if err := conn.config.Codec.DecodePayload(rawPayload, &data); err != nil {
+					conn.sendOperationErrors(msg.ID, []error{errors.New("Invalid GQL_START payload")})
 				} else {
 					errs := conn.config.EventHandlers.StartOperation(conn, msg.ID, &data)
 					if errs != nil {
@@ -330,6 +688,7 @@ func (conn *connection) readLoop() {
 		// close the connection and close the read loop
 		case gqlConnectionTerminate:
 			conn.logger.Debug("Connection terminated by client")
+			conn.terminated = true
 			conn.close()
 			return
 
@@ -0,0 +1,64 @@
+package graphqlws_test
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+)
+
+// countingData counts how often it is encoded as JSON.
+type countingData struct {
+	count *int32
+}
+
+func (d countingData) MarshalJSON() ([]byte, error) {
+	atomic.AddInt32(d.count, 1)
+	return []byte(`{"greeting":"hello"}`), nil
+}
+
+func TestPrepareData_EncodesPayloadOnce(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+	})
+	defer srv.Close()
+
+	clients := []*graphqlwstest.Client{srv.Dial(t), srv.Dial(t)}
+	for _, client := range clients {
+		defer client.Close()
+		client.Init(nil)
+		client.ExpectAck()
+		client.Start("1", "subscription { greeting }", nil)
+		client.Start("probe", "{", nil)
+		client.ExpectError("probe")
+	}
+
+	var count int32
+	prepared, err := graphqlws.PrepareData(&graphqlws.DataMessagePayload{
+		Data: countingData{&count},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, _ := json.Marshal(prepared)
+	if string(encoded) != `{"data":{"greeting":"hello"},"errors":null}` {
+		t.Error("Prepared payload is not encoded like the original:", string(encoded))
+	}
+
+	for _, subscriptions := range manager.Subscriptions() {
+		for _, subscription := range subscriptions {
+			subscription.SendData(prepared)
+		}
+	}
+	for _, client := range clients {
+		client.ExpectData("1", graphqlwstest.EqualJSON(`{"greeting": "hello"}`))
+	}
+
+	if n := atomic.LoadInt32(&count); n != 1 {
+		t.Errorf("Payload is encoded %d times", n)
+	}
+}
@@ -0,0 +1,231 @@
+package graphqlws
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default maximum size of GraphQL request bodies
+const defaultMaxBodySize = 1 << 20
+
+var (
+	// ErrMutationNotAllowed is returned for mutations sent via GET
+	// requests, which must not have side effects.
+	ErrMutationNotAllowed = errors.New("Mutations are not allowed in GET requests")
+
+	// ErrSubscriptionNotAllowed is returned for subscriptions sent via
+	// plain HTTP requests instead of a WebSocket connection.
+	ErrSubscriptionNotAllowed = errors.New("Subscriptions require a WebSocket connection")
+)
+
+// GraphQLHandlerConfig stores the configuration of a combined GraphQL
+// handler for queries and mutations over HTTP and subscriptions over
+// WebSockets.
+type GraphQLHandlerConfig struct {
+	// Schema is the schema queries and mutations are executed against.
+	Schema *graphql.Schema
+
+	// SubscriptionManager manages the subscriptions of WebSocket clients;
+	// defaults to a new subscription manager for the schema.
+	SubscriptionManager SubscriptionManager
+
+	// DocumentCache is an optional cache for parsed and validated
+	// queries and mutations; it is shared with the default subscription
+	// manager.
+	DocumentCache DocumentCache
+
+	// Authenticate resolves auth tokens into users, for both HTTP requests
+	// and WebSocket connections.
+	Authenticate AuthenticateFunc
+
+	// AuthToken extracts the auth token of HTTP requests; defaults to the
+	// bearer token of the Authorization header. WebSocket clients send
+	// their token in the connection_init message.
+	AuthToken func(*http.Request) string
+
+	// Context optionally builds the context of HTTP requests and
+	// WebSocket connections from the request and user.
+	Context ContextFunc
+
+	// FormatError optionally formats errors for both HTTP and WebSocket
+	// clients.
+	FormatError FormatErrorFunc
+
+	// RootObject is passed to the resolvers of queries and mutations.
+	RootObject map[string]interface{}
+
+	// MaxBodySize limits the size of POST request bodies; defaults to
+	// 1 MiB.
+	MaxBodySize int64
+
+	// RateLimit optionally limits how many messages WebSocket clients
+	// may send.
+	RateLimit *MessageRateLimit
+
+	// PersistedQueries enables support for automatic persisted queries.
+	PersistedQueries *PersistedQueryConfig
+
+	// Compression optionally enables compression of WebSocket messages.
+	Compression *Compression
+
+	// Codecs optionally offers WebSocket clients message encodings
+	// besides JSON.
+	Codecs []Codec
+
+	// Sessions optionally enables WebSocket clients to resume their
+	// operations after reconnecting.
+	Sessions *SessionConfig
+}
+
+// NewGraphQLHandler creates a single HTTP handler for a GraphQL API. It
+// executes queries and mutations sent via GET and POST requests and
+// upgrades requests with an "Upgrade: websocket" header into GraphQL
+// WebSocket connections for subscriptions. Authentication, context
+// construction and error formatting are shared by both.
+func NewGraphQLHandler(config GraphQLHandlerConfig) http.Handler {
+	if config.SubscriptionManager == nil {
+		config.SubscriptionManager = NewSubscriptionManagerWithConfig(SubscriptionManagerConfig{
+			Schema:        config.Schema,
+			DocumentCache: config.DocumentCache,
+		})
+	}
+	if config.AuthToken == nil {
+		config.AuthToken = bearerToken
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+
+	return &graphqlHandler{
+		config: config,
+		logger: NewLogger("graphql"),
+		websocketHandler: NewHandler(HandlerConfig{
+			SubscriptionManager: config.SubscriptionManager,
+			Authenticate:        config.Authenticate,
+			RateLimit:           config.RateLimit,
+			PersistedQueries:    config.PersistedQueries,
+			Context:             config.Context,
+			FormatError:         config.FormatError,
+			Compression:         config.Compression,
+			Codecs:              config.Codecs,
+			Sessions:            config.Sessions,
+		}),
+	}
+}
+
+type graphqlHandler struct {
+	config           GraphQLHandlerConfig
+	logger           *log.Entry
+	websocketHandler http.Handler
+}
+
+func (h *graphqlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		h.websocketHandler.ServeHTTP(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		h.writeErrors(w, http.StatusMethodNotAllowed, []error{errors.New("Method not allowed")})
+		return
+	}
+
+	user, err := authenticateRequest(h.config.Authenticate, h.config.AuthToken, r)
+	if err != nil {
+		h.writeErrors(w, http.StatusUnauthorized, []error{err})
+		return
+	}
+
+	data, _, err := readOperationRequest(w, r, h.config.MaxBodySize)
+	if err != nil {
+		h.writeErrors(w, http.StatusBadRequest, []error{err})
+		return
+	}
+
+	// Resolve automatic persisted queries into query texts
+	if err := ResolvePersistedQuery(h.config.PersistedQueries, data); err != nil {
+		h.writeErrors(w, http.StatusOK, []error{err})
+		return
+	}
+
+	// The document is parsed once, both to check the operation and to
+	// execute it
+	document, err := loadDocument(h.config.Schema, h.config.DocumentCache, data.Query)
+	if err != nil {
+		h.writeErrors(w, http.StatusOK, []error{gqlerrors.FormatError(err)})
+		return
+	}
+
+	// Reject operations that cannot be served over plain HTTP before
+	// reporting validation errors
+	if operation := requestedOperation(document.Document, data.OperationName); operation == "subscription" {
+		h.writeErrors(w, http.StatusBadRequest, []error{ErrSubscriptionNotAllowed})
+		return
+	} else if operation == "mutation" && r.Method == http.MethodGet {
+		w.Header().Set("Allow", http.MethodPost)
+		h.writeErrors(w, http.StatusMethodNotAllowed, []error{ErrMutationNotAllowed})
+		return
+	}
+	if len(document.Errors) > 0 {
+		h.writeErrors(w, http.StatusOK, document.Errors)
+		return
+	}
+
+	ctx := r.Context()
+	if h.config.Context != nil {
+		ctx = h.config.Context(ctx, r, user)
+	}
+
+	h.logger.WithFields(log.Fields{
+		"operation": data.OperationName,
+		"user":      user,
+	}).Debug("Execute operation")
+
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        *h.config.Schema,
+		Root:          h.config.RootObject,
+		AST:           document.Document,
+		OperationName: data.OperationName,
+		Args:          data.Variables,
+		Context:       ctx,
+	})
+
+	response := map[string]interface{}{}
+	if result.Data != nil {
+		response["data"] = result.Data
+	}
+	if len(result.Errors) > 0 {
+		response["errors"] = errorsForPayload(ErrorsFromGraphQLErrors(result.Errors), h.config.FormatError)
+	}
+	if len(result.Extensions) > 0 {
+		response["extensions"] = result.Extensions
+	}
+	writeJSONResponse(w, http.StatusOK, response)
+}
+
+func (h *graphqlHandler) writeErrors(w http.ResponseWriter, status int, errs []error) {
+	writeJSONResponse(w, status, map[string]interface{}{
+		"errors": errorsForPayload(errs, h.config.FormatError),
+	})
+}
+
+// requestedOperation returns the type of the operation a request asks
+// to execute, or an empty string if it cannot be determined.
+func requestedOperation(doc *ast.Document, operationName string) string {
+	defs := operationDefinitions(doc)
+	for _, def := range defs {
+		if operationName == "" && len(defs) == 1 {
+			return def.Operation
+		}
+		if def.Name != nil && def.Name.Value == operationName {
+			return def.Operation
+		}
+	}
+	return ""
+}
@@ -0,0 +1,192 @@
+package graphqlws_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+type userContextKey struct{}
+
+func newGraphQLTestServer(t *testing.T) (*httptest.Server, graphqlws.SubscriptionManager) {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"me": &graphql.Field{
+					Type: graphql.String,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return p.Context.Value(userContextKey{}), nil
+					},
+				},
+			},
+		}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Mutation",
+			Fields: graphql.Fields{"greet": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Subscription",
+			Fields: graphql.Fields{"greeting": &graphql.Field{Type: graphql.String}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manager := graphqlws.NewSubscriptionManager(&schema)
+	srv := httptest.NewServer(graphqlws.NewGraphQLHandler(graphqlws.GraphQLHandlerConfig{
+		Schema:              &schema,
+		SubscriptionManager: manager,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		Context: func(ctx context.Context, r *http.Request, user interface{}) context.Context {
+			return context.WithValue(ctx, userContextKey{}, user)
+		},
+		FormatError: func(err error) gqlerrors.FormattedError {
+			formatted := gqlerrors.FormatError(err)
+			formatted.Extensions = map[string]interface{}{"code": "TEST"}
+			return formatted
+		},
+	}))
+	return srv, manager
+}
+
+func TestGraphQLHandler_ServesQueriesOverHTTP(t *testing.T) {
+	srv, _ := newGraphQLTestServer(t)
+	defer srv.Close()
+
+	do := func(method string, target string, body string) (int, map[string]interface{}) {
+		req, _ := http.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer alice")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		response := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+			t.Fatal("Invalid response:", err)
+		}
+		return res.StatusCode, response
+	}
+
+	status, response := do("POST", srv.URL, `{"query": "{ me }"}`)
+	if data, _ := response["data"].(map[string]interface{}); status != http.StatusOK || data["me"] != "alice" {
+		t.Error("Query is not executed with the request context:", status, response)
+	}
+
+	status, response = do("GET", srv.URL+"?query="+url.QueryEscape("{ me }"), "")
+	if data, _ := response["data"].(map[string]interface{}); status != http.StatusOK || data["me"] != "alice" {
+		t.Error("Query is not executed for GET requests:", status, response)
+	}
+
+	status, _ = do("GET", srv.URL+"?query="+url.QueryEscape("mutation { greet }"), "")
+	if status != http.StatusMethodNotAllowed {
+		t.Error("Mutation is executed for GET request:", status)
+	}
+
+	status, _ = do("POST", srv.URL, `{"query": "subscription { greeting }"}`)
+	if status != http.StatusBadRequest {
+		t.Error("Subscription is accepted over HTTP:", status)
+	}
+
+	_, response = do("POST", srv.URL, `{"query": "{ unknown }"}`)
+	errors, _ := response["errors"].([]interface{})
+	if len(errors) != 1 || !strings.Contains(mustMarshal(t, errors[0]), `"code":"TEST"`) {
+		t.Error("Errors are not formatted:", response)
+	}
+}
+
+func TestGraphQLHandler_ParsesQueriesOnce(t *testing.T) {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := graphqlws.NewDocumentCache(10)
+	srv := httptest.NewServer(graphqlws.NewGraphQLHandler(graphqlws.GraphQLHandlerConfig{
+		Schema:        &schema,
+		RootObject:    map[string]interface{}{"hello": "world"},
+		DocumentCache: cache,
+	}))
+	defer srv.Close()
+
+	post := func(body string) string {
+		res, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		response := map[string]interface{}{}
+		json.NewDecoder(res.Body).Decode(&response)
+		return mustMarshal(t, response)
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := post(`{"query": "{ hello }"}`); response != `{"data":{"hello":"world"}}` {
+			t.Fatal("Unexpected response:", response)
+		}
+	}
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Hits != 1 {
+		t.Error("Query is not parsed once and reused:", stats)
+	}
+
+	if response := post(`{"query": "{"}`); !strings.Contains(response, "Syntax Error") {
+		t.Error("Syntax errors are not reported:", response)
+	}
+}
+
+func TestGraphQLHandler_UpgradesWebSockets(t *testing.T) {
+	srv, manager := newGraphQLTestServer(t)
+	defer srv.Close()
+
+	client := graphqlwstest.Dial(t, "ws"+strings.TrimPrefix(srv.URL, "http"), "graphql-ws")
+	defer client.Close()
+
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice"})
+	client.ExpectAck()
+
+	client.Start("1", "subscription { unknown }", nil)
+	if msg := client.ExpectError("1"); !strings.Contains(string(msg.Payload), `"code":"TEST"`) {
+		t.Error("Errors are not formatted:", string(msg.Payload))
+	}
+
+	// Operations are handled in order, so once the probe fails the
+	// subscription has been added
+	client.Start("2", "subscription { greeting }", nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+
+	for conn := range manager.Subscriptions() {
+		ctx := graphqlws.ConnectionContext(conn)
+		if ctx.Value(userContextKey{}) != "alice" {
+			t.Error("Connection context is not built for the user:", ctx)
+		}
+	}
+	if len(manager.Subscriptions()) != 1 {
+		t.Error("Subscription is not added:", manager.Subscriptions())
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,220 @@
+package graphqlws
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/parser"
+	log "github.com/sirupsen/logrus"
+)
+
+// Seed inputs are kept in testdata/fuzz/<FuzzTarget>; run a target with
+// e.g. go test -run '^$' -fuzz FuzzDecodeOperationMessage
+
+func FuzzDecodeOperationMessage(f *testing.F) {
+	f.Add([]byte(`{"type":"connection_init","payload":{"authToken":"token"}}`))
+	f.Add([]byte(`{"id":"1","type":"start","payload":{"query":"subscription { a }","variables":{"x":1}}}`))
+	f.Add([]byte(`{"id":"1","type":"start","payload":null}`))
+	f.Add([]byte(`{"id":"1","type":"stop"}`))
+
+	codec := NewJSONCodec()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg, rawPayload, err := codec.Decode(data)
+		if err != nil {
+			return
+		}
+
+		// Decode the payload the way the read loop does for each type
+		switch msg.Type {
+		case gqlConnectionInit:
+			if len(rawPayload) > 0 {
+				codec.DecodePayload(rawPayload, &InitMessagePayload{})
+			}
+		case gqlStart:
+			codec.DecodePayload(rawPayload, &StartMessagePayload{})
+		}
+
+		// Logging the message must not fail either
+		_ = msg.String()
+	})
+}
+
+func FuzzSubscriptionFieldNamesFromDocument(f *testing.F) {
+	f.Add("subscription { a }")
+	f.Add("subscription S($x: Int) { a(x: $x) { b } c }")
+	f.Add("subscription { ...F } fragment F on Subscription { a }")
+	f.Add("subscription { ... on Subscription { a } } query { b }")
+
+	f.Fuzz(func(t *testing.T, query string) {
+		doc, err := parser.Parse(parser.ParseParams{Source: query})
+		if err != nil {
+			return
+		}
+		subscriptionFieldNamesFromDocument(doc)
+	})
+}
+
+func FuzzConnection(f *testing.F) {
+	f.Add([]byte(`{"type":"connection_init","payload":{}}
+{"id":"1","type":"start","payload":{"query":"subscription { greeting }"}}
+{"id":"1","type":"stop"}
+{"type":"connection_terminate"}`))
+	f.Add([]byte(`{"id":"1","type":"start","payload":{"query":"subscription { greeting }"}}
+{"type":"connection_init","payload":{"authToken":"token"}}
+{"id":"1","type":"start","payload":{"query":"subscription { greeting }"}}
+{"id":"1","type":"start","payload":{"query":"subscription { greeting }"}}`))
+	f.Add([]byte(`{"type":"connection_init"}
+{"id":"1","type":"start","payload":42}
+{"id":"2","type":"start","payload":{"query":"{"}}
+{"id":"3","type":"unknown"}`))
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Subscription",
+			Fields: graphql.Fields{"greeting": &graphql.Field{Type: graphql.String}},
+		}),
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	level := log.GetLevel()
+	log.SetLevel(log.PanicLevel)
+	defer log.SetLevel(level)
+
+	f.Fuzz(func(t *testing.T, script []byte) {
+		manager := NewSubscriptionManager(&schema)
+		closed := make(chan Connection, 1)
+
+		client, server := newWebSocketPair(t)
+		defer client.Close()
+
+		NewConnection(server, ConnectionConfig{
+			Authenticate: func(token string) (interface{}, error) {
+				if token == "" {
+					return nil, errors.New("Missing token")
+				}
+				return token, nil
+			},
+			EventHandlers: ConnectionEventHandlers{
+				Close: func(conn Connection) {
+					manager.RemoveSubscriptions(conn)
+					closed <- conn
+				},
+				StartOperation: func(conn Connection, opID string, data *StartMessagePayload) []error {
+					return manager.AddSubscription(conn, &Subscription{
+						ID:            opID,
+						Query:         data.Query,
+						Variables:     data.Variables,
+						OperationName: data.OperationName,
+						Connection:    conn,
+						SendData:      func(*DataMessagePayload) {},
+					})
+				},
+				StopOperation: func(conn Connection, opID string) {
+					manager.RemoveSubscription(conn, &Subscription{ID: opID})
+				},
+			},
+		})
+
+		// Drain everything the server sends until the connection closes
+		go func() {
+			for {
+				if _, _, err := client.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for _, line := range bytes.Split(script, []byte("\n")) {
+			client.SetWriteDeadline(time.Now().Add(time.Second))
+			if err := client.WriteMessage(websocket.TextMessage, line); err != nil {
+				break
+			}
+		}
+		client.Close()
+
+		select {
+		case conn := <-closed:
+			if len(manager.Subscriptions()[conn]) > 0 {
+				t.Fatal("Subscriptions of closed connection are not removed")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Connection is not closed after the client disconnects")
+		}
+	})
+}
+
+// newWebSocketPair establishes a WebSocket connection over an in-memory
+// pipe and returns its client and server ends.
+func newWebSocketPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	clientConn, serverConn := net.Pipe()
+
+	type result struct {
+		ws  *websocket.Conn
+		err error
+	}
+	upgraded := make(chan result, 1)
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			upgraded <- result{err: err}
+			return
+		}
+		upgrader := websocket.Upgrader{Subprotocols: []string{"graphql-ws"}}
+		w := &pipeResponseWriter{
+			conn:   serverConn,
+			rw:     bufio.NewReadWriter(reader, bufio.NewWriter(serverConn)),
+			header: http.Header{},
+		}
+		ws, err := upgrader.Upgrade(w, req, nil)
+		upgraded <- result{ws, err}
+	}()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", "graphql-ws")
+	client, _, err := websocket.NewClient(clientConn, &url.URL{Scheme: "ws", Host: "pipe", Path: "/"}, header, 1024, 1024)
+	if err != nil {
+		t.Fatal("Failed to establish in-memory WebSocket connection:", err)
+	}
+
+	server := <-upgraded
+	if server.err != nil {
+		t.Fatal("Failed to upgrade in-memory WebSocket connection:", server.err)
+	}
+	return client, server.ws
+}
+
+// pipeResponseWriter lets the WebSocket upgrader hijack a net.Conn.
+type pipeResponseWriter struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	header http.Header
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) Write(data []byte) (int, error) {
+	return w.conn.Write(data)
+}
+
+func (w *pipeResponseWriter) WriteHeader(statusCode int) {}
+
+func (w *pipeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, w.rw, nil
+}
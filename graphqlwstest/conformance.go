@@ -0,0 +1,322 @@
+package graphqlwstest
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// ProtocolGraphQLWS is the legacy subscriptions-transport-ws protocol.
+	ProtocolGraphQLWS = "graphql-ws"
+
+	// ProtocolGraphQLTransportWS is the protocol of the graphql-ws library.
+	ProtocolGraphQLTransportWS = "graphql-transport-ws"
+)
+
+// ConformanceConfig configures the protocol conformance tests.
+type ConformanceConfig struct {
+	// Query is a valid subscription query for the handler's schema.
+	Query string
+
+	// InitPayload is sent with connection_init messages; it must be
+	// accepted by the handler.
+	InitPayload interface{}
+
+	// Publish, if set, triggers an event that produces data for
+	// subscriptions with Query, so that data delivery can be tested.
+	Publish func()
+
+	// MaxMessageSize is the size above which the handler rejects
+	// incoming frames; defaults to 1 MiB.
+	MaxMessageSize int
+
+	// Protocols are the subprotocols to test; defaults to both. Tests
+	// for protocols the handler does not negotiate are skipped.
+	Protocols []string
+
+	// Quiet is how long to wait when checking that the handler does not
+	// send a message; defaults to 200 milliseconds.
+	Quiet time.Duration
+}
+
+type conformanceCase struct {
+	name string
+	run  func(t *testing.T, c *Client, config *ConformanceConfig)
+}
+
+// RunConformanceTests runs a table-driven suite of protocol edge cases
+// against a handler that claims to implement the GraphQL WebSocket
+// protocol(s), such as start before init, duplicate operation IDs,
+// stopping unknown operations, malformed payloads, oversize frames and
+// terminating connections with active operations.
+func RunConformanceTests(t *testing.T, handler http.Handler, config ConformanceConfig) {
+	if config.Query == "" {
+		t.Fatal("graphqlwstest: ConformanceConfig.Query is required")
+	}
+	if config.MaxMessageSize <= 0 {
+		config.MaxMessageSize = 1 << 20
+	}
+	if len(config.Protocols) == 0 {
+		config.Protocols = []string{ProtocolGraphQLWS, ProtocolGraphQLTransportWS}
+	}
+	if config.Quiet <= 0 {
+		config.Quiet = 200 * time.Millisecond
+	}
+
+	srv := NewServerWithHandler(handler)
+	defer srv.Close()
+
+	// Handlers must implement at least one of the protocols
+	negotiated := false
+	for _, protocol := range config.Protocols {
+		c := Dial(t, srv.URL, protocol)
+		negotiated = negotiated || c.Conn().Subprotocol() == protocol
+		c.Close()
+	}
+	if !negotiated {
+		t.Fatalf("Handler implements none of the protocols %q", config.Protocols)
+	}
+
+	for _, protocol := range config.Protocols {
+		cases := graphqlWSConformanceCases
+		if protocol == ProtocolGraphQLTransportWS {
+			cases = graphqlTransportWSConformanceCases
+		}
+
+		for _, testCase := range cases {
+			testCase := testCase
+			t.Run(protocol+"/"+testCase.name, func(t *testing.T) {
+				c := Dial(t, srv.URL, protocol)
+				defer c.Close()
+				if c.Conn().Subprotocol() != protocol {
+					t.Skipf("Handler does not implement the %s protocol", protocol)
+				}
+				testCase.run(t, c, &config)
+			})
+		}
+	}
+}
+
+// expectErrorOrClose expects the handler to either respond with an
+// error message or to close the connection.
+func expectErrorOrClose(t *testing.T, c *Client, ids ...string) {
+	t.Helper()
+	msg, err := c.Next()
+	if err == ErrTimeout {
+		t.Fatal("Expected an error message or the connection to be closed, got nothing")
+	}
+	if err != nil {
+		return
+	}
+	if msg.Type != "error" && msg.Type != "connection_error" {
+		t.Fatalf("Expected an error message, got %q message: %s", msg.Type, msg.Payload)
+	}
+	for _, id := range ids {
+		if msg.ID == id {
+			return
+		}
+	}
+	t.Fatalf("Expected an error message for one of %q, got one for %q", ids, msg.ID)
+}
+
+// expectCloseCode expects the handler to close the connection with
+// the given close code.
+func expectCloseCode(t *testing.T, c *Client, code int) {
+	t.Helper()
+	err := c.ExpectClosed()
+	if !websocket.IsCloseError(err, code) {
+		t.Fatalf("Expected connection to be closed with code %d, got: %v", code, err)
+	}
+}
+
+// sendOversizeFrame sends a frame exceeding the maximum message size;
+// the handler may close the connection before the frame is written.
+func sendOversizeFrame(c *Client, config *ConformanceConfig) {
+	text := `{"type":"connection_init","payload":{"padding":"` +
+		strings.Repeat("x", config.MaxMessageSize) + `"}}`
+	c.Conn().SetWriteDeadline(time.Now().Add(DefaultTimeout))
+	c.Conn().WriteMessage(websocket.TextMessage, []byte(text))
+}
+
+func startPayload(query string) map[string]interface{} {
+	return map[string]interface{}{"query": query}
+}
+
+/**
+ * Conformance cases for the graphql-ws protocol.
+ */
+
+// probeGraphQLWS checks that the connection is still usable by starting
+// an operation with an unparsable query and expecting an error for it.
+func probeGraphQLWS(t *testing.T, c *Client) {
+	t.Helper()
+	c.Send("probe", "start", startPayload("{"))
+	c.ExpectError("probe")
+}
+
+func initGraphQLWS(t *testing.T, c *Client, config *ConformanceConfig) {
+	t.Helper()
+	c.Init(config.InitPayload)
+	c.ExpectAck()
+}
+
+var graphqlWSConformanceCases = []conformanceCase{
+	{"ConnectionInitIsAcknowledged", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+	}},
+	{"StartBeforeInitIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		c.Send("1", "start", startPayload(config.Query))
+		expectErrorOrClose(t, c, "1")
+	}},
+	{"ValidStartIsAccepted", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "start", startPayload(config.Query))
+		c.ExpectNoMessage(config.Quiet)
+		if config.Publish != nil {
+			config.Publish()
+			c.ExpectData("1", Any())
+		}
+	}},
+	{"InvalidQueryIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "start", startPayload("subscription { thisFieldDoesNotExist }"))
+		c.ExpectError("1")
+	}},
+	{"DuplicateOperationIDIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "start", startPayload(config.Query))
+		c.ExpectNoMessage(config.Quiet)
+		c.Send("1", "start", startPayload(config.Query))
+		expectErrorOrClose(t, c, "1")
+	}},
+	{"StopForUnknownIDIsIgnored", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("unknown", "stop", nil)
+		probeGraphQLWS(t, c)
+	}},
+	{"StopEndsOperation", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "start", startPayload(config.Query))
+		c.ExpectNoMessage(config.Quiet)
+		c.Send("1", "stop", nil)
+
+		// Servers may confirm stopping the operation
+		c.SetTimeout(config.Quiet)
+		msg, err := c.Next()
+		c.SetTimeout(DefaultTimeout)
+		if err == nil && (msg.Type != "complete" || msg.ID != "1") {
+			t.Fatalf("Unexpected %q message after stop: %s", msg.Type, msg.Payload)
+		}
+		if err != nil && err != ErrTimeout {
+			t.Fatal("Connection failed after stop:", err)
+		}
+
+		if config.Publish != nil {
+			config.Publish()
+			c.ExpectNoMessage(config.Quiet)
+		}
+	}},
+	{"MalformedStartPayloadIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "start", 42)
+		expectErrorOrClose(t, c, "1", "")
+	}},
+	{"MissingStartPayloadIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "start", nil)
+		expectErrorOrClose(t, c, "1", "")
+	}},
+	{"InvalidJSONIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.SendText("{this is not json")
+		expectErrorOrClose(t, c, "")
+	}},
+	{"UnknownMessageTypeIsIgnored", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("", "this_type_does_not_exist", nil)
+		probeGraphQLWS(t, c)
+	}},
+	{"OversizeFrameClosesConnection", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		sendOversizeFrame(c, config)
+		c.ExpectClosed()
+	}},
+	{"TerminateClosesConnectionMidStream", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "start", startPayload(config.Query))
+		c.ExpectNoMessage(config.Quiet)
+		c.Terminate()
+		c.ExpectClosed()
+	}},
+}
+
+/**
+ * Conformance cases for the graphql-transport-ws protocol, see
+ * https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+ */
+
+// probeGraphQLTransportWS checks that the connection is still usable by
+// sending a ping and expecting a pong.
+func probeGraphQLTransportWS(t *testing.T, c *Client) {
+	t.Helper()
+	c.Send("", "ping", nil)
+	c.Expect("", "pong")
+}
+
+var graphqlTransportWSConformanceCases = []conformanceCase{
+	{"ConnectionInitIsAcknowledged", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+	}},
+	{"DuplicateConnectionInitIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Init(config.InitPayload)
+		expectCloseCode(t, c, 4429)
+	}},
+	{"SubscribeBeforeInitIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		c.Send("1", "subscribe", startPayload(config.Query))
+		expectCloseCode(t, c, 4401)
+	}},
+	{"PingIsAnsweredWithPong", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		probeGraphQLTransportWS(t, c)
+	}},
+	{"ValidSubscribeIsAccepted", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "subscribe", startPayload(config.Query))
+		c.ExpectNoMessage(config.Quiet)
+		if config.Publish != nil {
+			config.Publish()
+			c.Expect("1", "next")
+		}
+	}},
+	{"DuplicateOperationIDIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "subscribe", startPayload(config.Query))
+		c.ExpectNoMessage(config.Quiet)
+		c.Send("1", "subscribe", startPayload(config.Query))
+		expectCloseCode(t, c, 4409)
+	}},
+	{"CompleteForUnknownIDIsIgnored", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("unknown", "complete", nil)
+		probeGraphQLTransportWS(t, c)
+	}},
+	{"MalformedSubscribePayloadIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.Send("1", "subscribe", 42)
+		expectCloseCode(t, c, 4400)
+	}},
+	{"InvalidJSONIsRejected", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		c.SendText("{this is not json")
+		expectCloseCode(t, c, 4400)
+	}},
+	{"OversizeFrameClosesConnection", func(t *testing.T, c *Client, config *ConformanceConfig) {
+		initGraphQLWS(t, c, config)
+		sendOversizeFrame(c, config)
+		c.ExpectClosed()
+	}},
+}
@@ -0,0 +1,346 @@
+// Package graphqlwstest provides utilities for testing applications
+// built on graphqlws: an in-process server, a scripted protocol client
+// with expectations and a mock Connection implementation.
+package graphqlwstest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/gorilla/websocket"
+)
+
+// DefaultTimeout is how long expectations wait for a message by default.
+const DefaultTimeout = 5 * time.Second
+
+// Server is a graphqlws handler served by an in-process HTTP server.
+type Server struct {
+	*httptest.Server
+
+	// URL is the WebSocket URL of the server.
+	URL string
+}
+
+// NewServer starts a server for a graphqlws handler with the given
+// configuration. The caller should call Close when finished.
+func NewServer(config graphqlws.HandlerConfig) *Server {
+	return NewServerWithHandler(graphqlws.NewHandler(config))
+}
+
+// NewServerWithHandler starts a server for an arbitrary handler that
+// implements the GraphQL WebSocket protocol.
+func NewServerWithHandler(handler http.Handler) *Server {
+	srv := httptest.NewServer(handler)
+	return &Server{
+		Server: srv,
+		URL:    "ws" + strings.TrimPrefix(srv.URL, "http"),
+	}
+}
+
+// Dial connects a scripted client to the server using the graphql-ws
+// subprotocol.
+func (s *Server) Dial(t testing.TB) *Client {
+	t.Helper()
+	return Dial(t, s.URL, "graphql-ws")
+}
+
+// Message is an operation message received from the server.
+type Message struct {
+	ID      string          `json:"id"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Matcher checks the data of a data message.
+type Matcher func(data json.RawMessage) error
+
+// EqualJSON matches data that is equal to the given JSON document,
+// regardless of formatting and key order.
+func EqualJSON(expected string) Matcher {
+	return func(data json.RawMessage) error {
+		var expectedValue, actualValue interface{}
+		if err := json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+			return fmt.Errorf("invalid expected JSON: %v", err)
+		}
+		if err := json.Unmarshal(data, &actualValue); err != nil {
+			return fmt.Errorf("invalid data: %v", err)
+		}
+		if !reflect.DeepEqual(expectedValue, actualValue) {
+			return fmt.Errorf("data %s does not equal %s", data, expected)
+		}
+		return nil
+	}
+}
+
+// Contains matches data whose JSON encoding contains a substring.
+func Contains(substring string) Matcher {
+	return func(data json.RawMessage) error {
+		if !strings.Contains(string(data), substring) {
+			return fmt.Errorf("data %s does not contain %q", data, substring)
+		}
+		return nil
+	}
+}
+
+// Any matches any data.
+func Any() Matcher {
+	return func(data json.RawMessage) error {
+		return nil
+	}
+}
+
+// ErrTimeout is returned by Client.Next if no message arrives in time.
+var ErrTimeout = errors.New("graphqlwstest: timed out waiting for message")
+
+// Client is a scripted GraphQL WebSocket client. It sends raw protocol
+// messages and fails the test if the server's responses do not meet
+// the expectations.
+type Client struct {
+	t        testing.TB
+	ws       *websocket.Conn
+	timeout  time.Duration
+	messages chan *Message
+	err      error
+
+	// Keep-alive messages are skipped by expectations unless disabled
+	SkipKeepAlives bool
+}
+
+// Dial connects a scripted client to a WebSocket URL, requesting the
+// given subprotocol.
+func Dial(t testing.TB, url string, subprotocol string) *Client {
+	t.Helper()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", subprotocol)
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("graphqlwstest: failed to connect to %s: %v", url, err)
+	}
+
+	client := &Client{
+		t:              t,
+		ws:             ws,
+		timeout:        DefaultTimeout,
+		messages:       make(chan *Message, 100),
+		SkipKeepAlives: true,
+	}
+
+	// Read messages in the background, so that waiting for a message
+	// can time out without breaking the connection
+	go client.readLoop()
+
+	return client
+}
+
+func (c *Client) readLoop() {
+	defer close(c.messages)
+	for {
+		msg := &Message{}
+		if err := c.ws.ReadJSON(msg); err != nil {
+			c.err = err
+			return
+		}
+		c.messages <- msg
+	}
+}
+
+// Conn returns the underlying WebSocket connection.
+func (c *Client) Conn() *websocket.Conn {
+	return c.ws
+}
+
+// SetTimeout sets how long expectations wait for a message.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// Close closes the connection.
+func (c *Client) Close() {
+	c.ws.Close()
+}
+
+// Send sends an operation message.
+func (c *Client) Send(id string, messageType string, payload interface{}) {
+	c.t.Helper()
+	msg := map[string]interface{}{"type": messageType}
+	if id != "" {
+		msg["id"] = id
+	}
+	if payload != nil {
+		msg["payload"] = payload
+	}
+	c.SendRaw(msg)
+}
+
+// SendRaw sends an arbitrary value encoded as JSON.
+func (c *Client) SendRaw(msg interface{}) {
+	c.t.Helper()
+	c.ws.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := c.ws.WriteJSON(msg); err != nil {
+		c.t.Fatalf("graphqlwstest: failed to send message: %v", err)
+	}
+}
+
+// SendText sends a text frame as is, e.g. to send malformed messages.
+func (c *Client) SendText(text string) {
+	c.t.Helper()
+	c.ws.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := c.ws.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		c.t.Fatalf("graphqlwstest: failed to send message: %v", err)
+	}
+}
+
+// Init sends a connection_init message with the given payload.
+func (c *Client) Init(payload interface{}) {
+	c.t.Helper()
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+	c.Send("", "connection_init", payload)
+}
+
+// Start starts an operation.
+func (c *Client) Start(id string, query string, variables map[string]interface{}) {
+	c.t.Helper()
+	c.Send(id, "start", graphqlws.StartMessagePayload{
+		Query:     query,
+		Variables: variables,
+	})
+}
+
+// Stop stops an operation.
+func (c *Client) Stop(id string) {
+	c.t.Helper()
+	c.Send(id, "stop", nil)
+}
+
+// Terminate terminates the connection.
+func (c *Client) Terminate() {
+	c.t.Helper()
+	c.Send("", "connection_terminate", nil)
+}
+
+// Next returns the next message from the server, or an error if there
+// is none within the timeout.
+func (c *Client) Next() (*Message, error) {
+	timeout := time.After(c.timeout)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				// The read loop sets the error before closing the channel
+				return nil, c.err
+			}
+			if c.SkipKeepAlives && msg.Type == "ka" {
+				continue
+			}
+			return msg, nil
+		case <-timeout:
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// Expect expects the next message to be of the given type and for
+// the given operation.
+func (c *Client) Expect(id string, messageType string) *Message {
+	c.t.Helper()
+	msg, err := c.Next()
+	if err != nil {
+		c.t.Fatalf("graphqlwstest: expected %q message, got error: %v", messageType, err)
+	}
+	if msg.Type != messageType || msg.ID != id {
+		c.t.Fatalf(
+			"graphqlwstest: expected %q message for operation %q, got %q message for %q: %s",
+			messageType, id, msg.Type, msg.ID, msg.Payload,
+		)
+	}
+	return msg
+}
+
+// ExpectAck expects the server to acknowledge the connection.
+func (c *Client) ExpectAck() {
+	c.t.Helper()
+	c.Expect("", "connection_ack")
+}
+
+// ExpectConnectionError expects the server to reject the connection.
+func (c *Client) ExpectConnectionError() *Message {
+	c.t.Helper()
+	return c.Expect("", "connection_error")
+}
+
+// ExpectData expects a data message for an operation whose data
+// satisfies the matcher. It returns the full data payload.
+func (c *Client) ExpectData(id string, matcher Matcher) *Message {
+	c.t.Helper()
+	msg := c.Expect(id, "data")
+
+	payload := struct {
+		Data json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+		c.t.Fatalf("graphqlwstest: invalid data payload %s: %v", msg.Payload, err)
+	}
+	if matcher != nil {
+		if err := matcher(payload.Data); err != nil {
+			c.t.Fatalf("graphqlwstest: unexpected data for operation %q: %v", id, err)
+		}
+	}
+	return msg
+}
+
+// ExpectError expects an error message for an operation; use an empty
+// ID for errors that are not associated with an operation.
+func (c *Client) ExpectError(id string) *Message {
+	c.t.Helper()
+	return c.Expect(id, "error")
+}
+
+// ExpectComplete expects an operation to be completed by the server.
+func (c *Client) ExpectComplete(id string) {
+	c.t.Helper()
+	c.Expect(id, "complete")
+}
+
+// ExpectNoMessage expects the server not to send anything for the
+// given duration.
+func (c *Client) ExpectNoMessage(duration time.Duration) {
+	c.t.Helper()
+	timeout := c.timeout
+	c.timeout = duration
+	defer func() { c.timeout = timeout }()
+
+	msg, err := c.Next()
+	if err == nil {
+		c.t.Fatalf("graphqlwstest: expected no message, got %q message: %s", msg.Type, msg.Payload)
+	}
+	if err != ErrTimeout {
+		c.t.Fatalf("graphqlwstest: expected no message, got error: %v", err)
+	}
+}
+
+// ExpectClosed expects the server to close the connection and
+// returns the close error.
+func (c *Client) ExpectClosed() error {
+	c.t.Helper()
+	for {
+		_, err := c.Next()
+		if err == nil {
+			continue
+		}
+		if err == ErrTimeout {
+			c.t.Fatal("graphqlwstest: expected connection to be closed, got timeout")
+		}
+		return err
+	}
+}
@@ -0,0 +1,124 @@
+package graphqlwstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/graphql-go/graphql"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.ErrorLevel)
+	m.Run()
+}
+
+func buildSchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{
+					Type: graphql.String,
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"greeting": &graphql.Field{
+					Type: graphql.String,
+				},
+			},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+func TestServer_ScriptedClientMeetsExpectations(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSchema(t))
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+	})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	defer client.Close()
+
+	client.Init(nil)
+	client.ExpectAck()
+
+	client.Start("1", "subscription { unknown }", nil)
+	client.ExpectError("1")
+
+	client.Start("2", "subscription { greeting }", nil)
+	client.ExpectNoMessage(100 * time.Millisecond)
+
+	for _, subscriptions := range manager.Subscriptions() {
+		for _, subscription := range subscriptions {
+			subscription.SendData(&graphqlws.DataMessagePayload{
+				Data: map[string]interface{}{"greeting": "hello"},
+			})
+		}
+	}
+	client.ExpectData("2", graphqlwstest.EqualJSON(`{"greeting": "hello"}`))
+
+	client.Terminate()
+	client.ExpectClosed()
+}
+
+func TestMockConnection_RecordsSentData(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSchema(t))
+	conn := graphqlwstest.NewMockConnection("1", "alice")
+
+	errors := manager.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "a",
+		Query:      "subscription { greeting }",
+		Connection: conn,
+		SendData:   conn.SendDataFunc("a"),
+	})
+	if len(errors) > 0 {
+		t.Fatal("AddSubscription fails with a mock connection:", errors)
+	}
+
+	go manager.Subscriptions()[conn]["a"].SendData(&graphqlws.DataMessagePayload{
+		Data: "hello",
+	})
+
+	if !conn.WaitForData(1, time.Second) {
+		t.Fatal("MockConnection does not record sent data")
+	}
+	if data := conn.DataFor("a"); len(data) != 1 || data[0].Data != "hello" {
+		t.Error("MockConnection records unexpected data:", data)
+	}
+}
+
+func TestConformance_Handler(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSchema(t))
+	handler := graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Authenticate: func(token string) (interface{}, error) {
+			return "alice", nil
+		},
+	})
+
+	graphqlwstest.RunConformanceTests(t, handler, graphqlwstest.ConformanceConfig{
+		Query:          "subscription { greeting }",
+		InitPayload:    graphqlws.InitMessagePayload{AuthToken: "token"},
+		MaxMessageSize: 4096,
+		Publish: func() {
+			for _, subscriptions := range manager.Subscriptions() {
+				for _, subscription := range subscriptions {
+					subscription.SendData(&graphqlws.DataMessagePayload{
+						Data: map[string]interface{}{"greeting": "hello"},
+					})
+				}
+			}
+		},
+	})
+}
@@ -0,0 +1,123 @@
+package graphqlwstest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+)
+
+// SentData is a data payload sent to a mock connection.
+type SentData struct {
+	OperationID string
+	Payload     *graphqlws.DataMessagePayload
+}
+
+// MockConnection is a graphqlws.Connection that records everything
+// sent to it, for unit-testing code that uses a SubscriptionManager.
+type MockConnection struct {
+	id   string
+	user interface{}
+
+	mutex  sync.Mutex
+	data   []SentData
+	errors []error
+	notify chan struct{}
+}
+
+// NewMockConnection creates a mock connection with an ID and a user.
+func NewMockConnection(id string, user interface{}) *MockConnection {
+	return &MockConnection{
+		id:     id,
+		user:   user,
+		notify: make(chan struct{}),
+	}
+}
+
+// ID returns the ID of the connection.
+func (c *MockConnection) ID() string {
+	return c.id
+}
+
+// User returns the user of the connection.
+func (c *MockConnection) User() interface{} {
+	return c.user
+}
+
+// SendData records data sent for an operation.
+func (c *MockConnection) SendData(opID string, data *graphqlws.DataMessagePayload) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.data = append(c.data, SentData{OperationID: opID, Payload: data})
+	c.broadcast()
+}
+
+// SendError records an error sent to the connection.
+func (c *MockConnection) SendError(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.errors = append(c.errors, err)
+	c.broadcast()
+}
+
+// broadcast wakes up everyone waiting for data; the mutex must be held.
+func (c *MockConnection) broadcast() {
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+// Data returns all data sent to the connection so far.
+func (c *MockConnection) Data() []SentData {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]SentData(nil), c.data...)
+}
+
+// DataFor returns all data sent for an operation so far.
+func (c *MockConnection) DataFor(opID string) []*graphqlws.DataMessagePayload {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	payloads := []*graphqlws.DataMessagePayload{}
+	for _, data := range c.data {
+		if data.OperationID == opID {
+			payloads = append(payloads, data.Payload)
+		}
+	}
+	return payloads
+}
+
+// Errors returns all errors sent to the connection so far.
+func (c *MockConnection) Errors() []error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]error(nil), c.errors...)
+}
+
+// SendDataFunc returns a SendData function for a subscription of this
+// connection, as set up by graphqlws.NewHandler.
+func (c *MockConnection) SendDataFunc(opID string) graphqlws.SubscriptionSendDataFunc {
+	return func(data *graphqlws.DataMessagePayload) {
+		c.SendData(opID, data)
+	}
+}
+
+// WaitForData waits until at least n data payloads have been sent to
+// the connection, returning false if that doesn't happen in time.
+func (c *MockConnection) WaitForData(n int, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		c.mutex.Lock()
+		count, notify := len(c.data), c.notify
+		c.mutex.Unlock()
+
+		if count >= n {
+			return true
+		}
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return false
+		}
+	}
+}
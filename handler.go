@@ -1,6 +1,7 @@
 package graphqlws
 
 import (
+	"context"
 	"net/http"
 	"sync"
 
@@ -12,28 +13,86 @@ import (
 type HandlerConfig struct {
 	SubscriptionManager SubscriptionManager
 	Authenticate        AuthenticateFunc
+
+	// RateLimit optionally limits how many messages each client may send.
+	RateLimit *MessageRateLimit
+
+	// PersistedQueries enables support for automatic persisted queries;
+	// without it, start messages referencing a query hash are rejected.
+	PersistedQueries *PersistedQueryConfig
+
+	// Context optionally builds the context of connections from their
+	// upgrade request and user; see ConnectionContext.
+	Context ContextFunc
+
+	// FormatError optionally formats errors sent to clients.
+	FormatError FormatErrorFunc
+
+	// Compression optionally enables permessage-deflate compression of
+	// messages sent to clients that support it.
+	Compression *Compression
+
+	// Codecs optionally offers clients message encodings besides JSON,
+	// each negotiated via its own subprotocol. Clients offering several
+	// subprotocols get the first of these codecs they support, falling
+	// back to JSON.
+	Codecs []Codec
+
+	// Sessions optionally enables clients to resume their operations
+	// after reconnecting, with a session token sent to them in the
+	// connection ack message.
+	Sessions *SessionConfig
 }
 
+// ContextFunc builds the context operations of a user are executed
+// with, from a base context and the HTTP request of the user (for
+// WebSocket connections, the upgrade request).
+type ContextFunc func(ctx context.Context, r *http.Request, user interface{}) context.Context
+
 // NewHandler creates a WebSocket handler for GraphQL WebSocket connections.
 // This handler takes a SubscriptionManager and adds/removes subscriptions
 // as they are started/stopped by the client.
 func NewHandler(config HandlerConfig) http.Handler {
+	// Offer any additional codecs in preference to the "graphql-ws"
+	// protocol with JSON messages
+	codecs := append(append([]Codec{}, config.Codecs...), NewJSONCodec())
+	subprotocols := make([]string, len(codecs))
+	for i, codec := range codecs {
+		subprotocols[i] = codec.Subprotocol()
+	}
+
 	// Create a WebSocket upgrader that requires clients to implement
 	// the "graphql-ws" protocol
 	var upgrader = websocket.Upgrader{
 		CheckOrigin:  func(r *http.Request) bool { return true },
-		Subprotocols: []string{"graphql-ws"},
+		Subprotocols: subprotocols,
+
+		EnableCompression: config.Compression != nil,
 	}
 
 	logger := NewLogger("handler")
 	subscriptionManager := config.SubscriptionManager
 
+	// Operations are registered with the sessions of connections, if
+	// enabled, so that they survive reconnects
+	var sessions *sessionStore
+	session := func(conn Connection) Connection { return conn }
+	if config.Sessions != nil {
+		sessions = newSessionStore(*config.Sessions, subscriptionManager)
+		session = sessions.connection
+	}
+
 	// Create a map (used like a set) to manage client connections
 	var connections = make(map[Connection]bool)
 	connlock := sync.Mutex{}
 
 	return http.HandlerFunc(
 		func(w http.ResponseWriter, r *http.Request) {
+			// Count the bytes sent over compressed connections
+			if config.Compression != nil && offersCompression(r) {
+				w = countingResponseWriter{w}
+			}
+
 			// Establish a WebSocket connection
 			var ws, err = upgrader.Upgrade(w, r, nil)
 
@@ -44,15 +103,29 @@ func NewHandler(config HandlerConfig) http.Handler {
 			}
 
 			// Close the connection early if it doesn't implement the graphql-ws protocol
-			if ws.Subprotocol() != "graphql-ws" {
+			codec := codecForSubprotocol(codecs, ws.Subprotocol())
+			if codec == nil {
 				logger.Warn("Connection does not implement the GraphQL WS protocol")
 				ws.Close()
 				return
 			}
 
+			// Derive connection contexts from the upgrade request
+			var connectionContext func(context.Context, interface{}) context.Context
+			if config.Context != nil {
+				connectionContext = func(ctx context.Context, user interface{}) context.Context {
+					return config.Context(ctx, r, user)
+				}
+			}
+
 			// Establish a GraphQL WebSocket connection
 			conn := NewConnection(ws, ConnectionConfig{
 				Authenticate: config.Authenticate,
+				RateLimit:    config.RateLimit,
+				Context:      connectionContext,
+				FormatError:  config.FormatError,
+				Compression:  config.Compression,
+				Codec:        codec,
 				EventHandlers: ConnectionEventHandlers{
 					Close: func(conn Connection) {
 						logger.WithFields(log.Fields{
@@ -60,7 +133,11 @@ func NewHandler(config HandlerConfig) http.Handler {
 							"user": conn.User(),
 						}).Debug("Closing connection")
 
+						if sessions != nil {
+							sessions.detach(conn)
+						}
 						subscriptionManager.RemoveSubscriptions(conn)
+						RemoveConnection(subscriptionManager, conn)
 
 						connlock.Lock()
 						defer connlock.Unlock()
@@ -77,22 +154,31 @@ func NewHandler(config HandlerConfig) http.Handler {
 							"user": conn.User(),
 						}).Debug("Start operation")
 
-						return subscriptionManager.AddSubscription(conn, &Subscription{
-							ID:            opID,
-							Query:         data.Query,
-							Variables:     data.Variables,
-							OperationName: data.OperationName,
-							Connection:    conn,
-							SendData: func(data *DataMessagePayload) {
-								conn.SendData(opID, data)
-							},
-						})
+						// Operations started before init would be registered
+						// with the connection, out of reach of later stops
+						target := session(conn)
+						if sessions != nil && target == conn {
+							return []error{ErrConnectionNotInitialized}
+						}
+						return startOperation(subscriptionManager, config.PersistedQueries, target, opID, data)
 					},
 					StopOperation: func(conn Connection, opID string) {
-						subscriptionManager.RemoveSubscription(conn, &Subscription{
+						subscriptionManager.RemoveSubscription(session(conn), &Subscription{
 							ID: opID,
 						})
 					},
+					Init: func(conn Connection, data *InitMessagePayload) interface{} {
+						if sessions == nil {
+							return nil
+						}
+						return sessions.init(conn, data)
+					},
+					Acknowledged: func(conn Connection) {
+						AddConnection(subscriptionManager, session(conn))
+						if sessions != nil {
+							sessions.acknowledged(conn)
+						}
+					},
 				},
 			})
 
@@ -102,3 +188,30 @@ func NewHandler(config HandlerConfig) http.Handler {
 		},
 	)
 }
+
+// startOperation registers an operation started by a client with the
+// subscription manager; results are sent back via the connection.
+func startOperation(
+	subscriptionManager SubscriptionManager,
+	persistedQueries *PersistedQueryConfig,
+	conn Connection,
+	opID string,
+	data *StartMessagePayload,
+) []error {
+	// Resolve automatic persisted queries into query texts
+	if err := ResolvePersistedQuery(persistedQueries, data); err != nil {
+		return []error{err}
+	}
+
+	return subscriptionManager.AddSubscription(conn, &Subscription{
+		ID:            opID,
+		Query:         data.Query,
+		Variables:     data.Variables,
+		OperationName: data.OperationName,
+		Extensions:    data.Extensions,
+		Connection:    conn,
+		SendData: func(data *DataMessagePayload) {
+			conn.SendData(opID, data)
+		},
+	})
+}
@@ -0,0 +1,186 @@
+package graphqlws
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrHistoryTruncated is sent to subscriptions resuming after a cursor
+// when some of the events following it are no longer retained.
+var ErrHistoryTruncated = errors.New("Events following the cursor are no longer retained")
+
+const (
+	// Default number of events retained per topic
+	defaultHistorySize = 100
+
+	// Default time events are retained for
+	defaultHistoryRetention = time.Minute
+)
+
+// Event is an event published to a topic, as recorded in an event
+// history.
+type Event struct {
+	// ID identifies the event; IDs increase monotonically across all
+	// topics of a history.
+	ID uint64
+
+	Topic   string
+	Payload interface{}
+	Time    time.Time
+}
+
+// EventHistory records the events published to topics, so that
+// subscribers resuming after a disconnect can be sent the events they
+// missed.
+type EventHistory interface {
+	// Append records an event published to a topic and assigns it an ID.
+	Append(topic string, payload interface{}) (Event, error)
+
+	// Since returns the retained events of a topic with an ID greater
+	// than the cursor, oldest first, and whether these are all events
+	// published to the topic after the cursor; they are not if events
+	// following the cursor have already been dropped.
+	Since(topic string, cursor uint64) ([]Event, bool, error)
+
+	// Retention returns how long events are retained.
+	Retention() time.Duration
+}
+
+// EventHistoryConfig defines the configuration parameters of an
+// in-memory event history.
+type EventHistoryConfig struct {
+	// Size is the number of events retained per topic; defaults to 100.
+	Size int
+
+	// Retention is how long events are retained; defaults to 1 minute.
+	Retention time.Duration
+}
+
+/**
+ * The default, in-memory implementation of the EventHistory interface.
+ */
+
+// eventRing is a ring buffer holding the latest events of a topic.
+type eventRing struct {
+	events []Event
+	start  int
+	count  int
+
+	// ID of the latest event dropped to make room for newer ones
+	dropped uint64
+}
+
+func (r *eventRing) push(event Event) {
+	if r.count < len(r.events) {
+		r.events[(r.start+r.count)%len(r.events)] = event
+		r.count++
+		return
+	}
+	r.dropped = r.events[r.start].ID
+	r.events[r.start] = event
+	r.start = (r.start + 1) % len(r.events)
+}
+
+func (r *eventRing) at(i int) Event {
+	return r.events[(r.start+i)%len(r.events)]
+}
+
+type inMemoryEventHistory struct {
+	size      int
+	retention time.Duration
+
+	mutex     *sync.Mutex
+	lastID    uint64
+	topics    map[string]*eventRing
+	lastPrune time.Time
+
+	// IDs of the latest events of pruned topics, so that cursors can
+	// still be told apart from ones that missed events
+	expired map[string]uint64
+}
+
+// NewInMemoryEventHistory creates an event history that keeps the
+// latest events of each topic in memory. Event IDs are only unique
+// within the process, so clients must resume on the same instance.
+func NewInMemoryEventHistory(config EventHistoryConfig) EventHistory {
+	h := &inMemoryEventHistory{
+		size:      config.Size,
+		retention: config.Retention,
+		mutex:     &sync.Mutex{},
+		topics:    make(map[string]*eventRing),
+		lastPrune: time.Now(),
+		expired:   make(map[string]uint64),
+	}
+	if h.size <= 0 {
+		h.size = defaultHistorySize
+	}
+	if h.retention <= 0 {
+		h.retention = defaultHistoryRetention
+	}
+	return h
+}
+
+func (h *inMemoryEventHistory) Append(topic string, payload interface{}) (Event, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.lastPrune) > h.retention {
+		h.prune(now)
+	}
+
+	h.lastID++
+	event := Event{ID: h.lastID, Topic: topic, Payload: payload, Time: now}
+
+	ring := h.topics[topic]
+	if ring == nil {
+		ring = &eventRing{events: make([]Event, h.size), dropped: h.expired[topic]}
+		h.topics[topic] = ring
+		delete(h.expired, topic)
+	}
+	ring.push(event)
+	return event, nil
+}
+
+func (h *inMemoryEventHistory) Since(topic string, cursor uint64) ([]Event, bool, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	events := []Event{}
+	ring := h.topics[topic]
+	if ring == nil {
+		return events, cursor >= h.expired[topic], nil
+	}
+	complete := cursor >= ring.dropped
+	oldest := time.Now().Add(-h.retention)
+	for i := 0; i < ring.count; i++ {
+		event := ring.at(i)
+		if event.ID <= cursor {
+			continue
+		}
+		if event.Time.After(oldest) {
+			events = append(events, event)
+		} else {
+			complete = false
+		}
+	}
+	return events, complete, nil
+}
+
+func (h *inMemoryEventHistory) Retention() time.Duration {
+	return h.retention
+}
+
+// prune drops the topics whose latest event has expired, remembering
+// the ID of that event; the mutex must be held.
+func (h *inMemoryEventHistory) prune(now time.Time) {
+	oldest := now.Add(-h.retention)
+	for topic, ring := range h.topics {
+		if latest := ring.at(ring.count - 1); !latest.Time.After(oldest) {
+			h.expired[topic] = latest.ID
+			delete(h.topics, topic)
+		}
+	}
+	h.lastPrune = now
+}
@@ -0,0 +1,166 @@
+package graphqlws_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+)
+
+func TestInMemoryEventHistory_RetainsLatestEvents(t *testing.T) {
+	history := graphqlws.NewInMemoryEventHistory(graphqlws.EventHistoryConfig{
+		Size:      2,
+		Retention: 50 * time.Millisecond,
+	})
+	for _, payload := range []string{"a", "b", "c"} {
+		history.Append("letters", payload)
+	}
+	history.Append("digits", "1")
+
+	events, complete, _ := history.Since("letters", 0)
+	if len(events) != 2 || events[0].Payload != "b" || events[1].Payload != "c" {
+		t.Fatal("Latest events are not retained:", events)
+	}
+	if events[0].ID != 2 || events[1].ID != 3 {
+		t.Error("Event IDs do not increase monotonically:", events)
+	}
+	if complete {
+		t.Error("Dropped events are not reported")
+	}
+	if events, complete, _ := history.Since("letters", 2); len(events) != 1 || events[0].Payload != "c" || !complete {
+		t.Error("Events are not returned after cursor:", events, complete)
+	}
+	if _, complete, _ := history.Since("letters", 1); !complete {
+		t.Error("Events after the latest dropped event are reported incomplete")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if events, complete, _ := history.Since("digits", 0); len(events) != 0 || complete {
+		t.Error("Events outlive the retention window:", events, complete)
+	}
+
+	// Cursors are still checked after their topic has been pruned
+	history.Append("other", "x")
+	if _, complete, _ := history.Since("digits", 0); complete {
+		t.Error("Events of pruned topics are not reported missing")
+	}
+	if _, complete, _ := history.Since("digits", 4); !complete {
+		t.Error("Cursors after the events of pruned topics are reported incomplete")
+	}
+}
+
+func TestPubSubBridge_ReplaysEventsAfterCursor(t *testing.T) {
+	schema := buildMessageSchema(t)
+	pubsub := &countingPubSub{PubSub: graphqlws.NewInMemoryPubSub(), active: map[string]int{}}
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema:  schema,
+		PubSub:  pubsub,
+		Topic:   channelTopic,
+		History: graphqlws.NewInMemoryEventHistory(graphqlws.EventHistoryConfig{}),
+	})
+	defer bridge.Close()
+
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{SubscriptionManager: bridge})
+	defer srv.Close()
+
+	query := `subscription { messageAdded(channel: "general") { text } }`
+	client := srv.Dial(t)
+	client.Init(nil)
+	client.ExpectAck()
+	client.Start("1", query, nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+
+	pubsub.Publish("messageAdded.general", map[string]interface{}{"text": "one"})
+	client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "one"}}`))
+
+	// Events keep being recorded while the client is away
+	client.Terminate()
+	client.ExpectClosed()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(bridge.Subscriptions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := pubsub.count("messageAdded.general"); n != 1 {
+		t.Fatal("Topic is not subscribed to after its last subscription:", n)
+	}
+	pubsub.Publish("messageAdded.general", map[string]interface{}{"text": "two"})
+	pubsub.Publish("messageAdded.general", map[string]interface{}{"text": "three"})
+
+	client = srv.Dial(t)
+	defer client.Close()
+	client.Init(nil)
+	client.ExpectAck()
+	client.Send("1", "start", graphqlws.StartMessagePayload{
+		Query: query,
+		Extensions: &graphqlws.StartMessageExtensions{
+			Resume: &graphqlws.ResumeExtension{Cursor: 1},
+		},
+	})
+	for i, text := range []string{"two", "three"} {
+		msg := client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "`+text+`"}}`))
+		if cursor := fmt.Sprintf(`"extensions":{"cursor":%d}`, i+2); !strings.Contains(string(msg.Payload), cursor) {
+			t.Errorf("Replayed event lacks cursor: %s", msg.Payload)
+		}
+	}
+
+	pubsub.Publish("messageAdded.general", map[string]interface{}{"text": "four"})
+	client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "four"}}`))
+}
+
+func TestPubSubBridge_SignalsTruncatedHistory(t *testing.T) {
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema: buildMessageSchema(t),
+		Topic:  channelTopic,
+		History: graphqlws.NewInMemoryEventHistory(graphqlws.EventHistoryConfig{
+			Size: 1,
+		}),
+	})
+	defer bridge.Close()
+
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{SubscriptionManager: bridge})
+	defer srv.Close()
+
+	query := `subscription { messageAdded(channel: "general") { text } }`
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Init(nil)
+	client.ExpectAck()
+	client.Start("1", query, nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+	for _, text := range []string{"one", "two", "three"} {
+		bridge.PubSub().Publish("messageAdded.general", map[string]interface{}{"text": text})
+		client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "`+text+`"}}`))
+	}
+
+	// Only the latest event is retained, so resuming after the first
+	// misses the second
+	client.Send("2", "start", graphqlws.StartMessagePayload{
+		Query: query,
+		Extensions: &graphqlws.StartMessageExtensions{
+			Resume: &graphqlws.ResumeExtension{Cursor: 1},
+		},
+	})
+	msg := client.ExpectData("2", graphqlwstest.Any())
+	if payload := string(msg.Payload); !strings.Contains(payload, `"truncated":true`) ||
+		!strings.Contains(payload, graphqlws.ErrHistoryTruncated.Error()) {
+		t.Errorf("Truncated history is not signalled: %s", payload)
+	}
+	client.ExpectData("2", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "three"}}`))
+
+	// Resuming after the second misses nothing
+	client.Send("3", "start", graphqlws.StartMessagePayload{
+		Query: query,
+		Extensions: &graphqlws.StartMessageExtensions{
+			Resume: &graphqlws.ResumeExtension{Cursor: 2},
+		},
+	})
+	client.ExpectData("3", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "three"}}`))
+}
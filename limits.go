@@ -0,0 +1,388 @@
+package graphqlws
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+var (
+	// ErrConnectionOperationLimit is returned when a connection tries to
+	// start more operations than allowed.
+	ErrConnectionOperationLimit = errors.New("Too many active operations on this connection")
+
+	// ErrUserOperationLimit is returned when a user tries to start more
+	// operations than allowed across all their connections.
+	ErrUserOperationLimit = errors.New("Too many active operations for this user")
+
+	// ErrGlobalOperationLimit is returned when the server cannot accept
+	// any more operations.
+	ErrGlobalOperationLimit = errors.New("Too many active operations on this server")
+
+	// ErrStartRateLimit is returned when a connection starts operations
+	// faster than allowed.
+	ErrStartRateLimit = errors.New("Operations are being started too quickly")
+)
+
+// UserKeyFunc derives a key identifying a user from the value returned
+// by Connection.User(). An empty key means the connection has no user.
+type UserKeyFunc func(user interface{}) string
+
+func defaultUserKey(user interface{}) string {
+	if user == nil {
+		return ""
+	}
+	return fmt.Sprint(user)
+}
+
+// OperationLimits defines how many operations may be active at the
+// same time and how quickly they may be started. Limits that are zero
+// are not enforced.
+type OperationLimits struct {
+	// MaxPerConnection is the maximum number of active operations of
+	// a single connection.
+	MaxPerConnection int
+
+	// MaxPerUser is the maximum number of active operations of a single
+	// user, across all of their connections.
+	MaxPerUser int
+
+	// MaxTotal is the maximum number of active operations overall.
+	MaxTotal int
+
+	// StartsPerSecond is the rate at which a connection may start
+	// operations, to stop subscribe/unsubscribe storms.
+	StartsPerSecond float64
+
+	// StartBurst is the number of operations a connection may start
+	// at once before being rate limited; defaults to 1.
+	StartBurst int
+
+	// UserKey identifies users for MaxPerUser; defaults to formatting
+	// the user with fmt.Sprint.
+	UserKey UserKeyFunc
+}
+
+func (limits *OperationLimits) userKey(conn Connection) string {
+	if limits.UserKey != nil {
+		return limits.UserKey(conn.User())
+	}
+	return defaultUserKey(conn.User())
+}
+
+// QueryLimits defines limits on the shape and size of subscription
+// queries. Subscriptions are re-executed on every event, so deeply
+// nested or fanned-out queries are expensive. Limits that are zero
+// are not enforced.
+type QueryLimits struct {
+	// MaxDepth is the maximum nesting depth of fields.
+	MaxDepth int
+
+	// MaxRootFields is the maximum number of top-level fields per
+	// operation.
+	MaxRootFields int
+
+	// MaxAliases is the maximum number of aliased fields per operation.
+	MaxAliases int
+
+	// MaxComplexity is the maximum complexity of an operation, which is
+	// the sum of the costs of all its fields.
+	MaxComplexity int
+
+	// FieldCosts defines the costs of individual fields, keyed by
+	// "Type.field" (e.g. "Subscription.posts"). Fields without a cost
+	// cost DefaultFieldCost.
+	FieldCosts map[string]int
+
+	// DefaultFieldCost is the cost of fields without an entry in
+	// FieldCosts; defaults to 1.
+	DefaultFieldCost int
+}
+
+// QueryStats describes the shape and size of an operation.
+type QueryStats struct {
+	Depth      int
+	RootFields int
+	Aliases    int
+	Complexity int
+}
+
+// Check returns errors for all limits the operations in a document
+// exceed.
+func (limits *QueryLimits) Check(schema *graphql.Schema, document *ast.Document) []error {
+	errs := []error{}
+
+	for _, def := range operationDefinitions(document) {
+		stats := limits.Stats(schema, document, def)
+		name := "operation"
+		if def.Name != nil {
+			name = fmt.Sprintf("operation %q", def.Name.Value)
+		}
+
+		if limits.MaxDepth > 0 && stats.Depth > limits.MaxDepth {
+			errs = append(errs, fmt.Errorf(
+				"The %s has a depth of %d, which exceeds the maximum depth of %d",
+				name, stats.Depth, limits.MaxDepth,
+			))
+		}
+		if limits.MaxRootFields > 0 && stats.RootFields > limits.MaxRootFields {
+			errs = append(errs, fmt.Errorf(
+				"The %s selects %d root fields, which exceeds the maximum of %d",
+				name, stats.RootFields, limits.MaxRootFields,
+			))
+		}
+		if limits.MaxAliases > 0 && stats.Aliases > limits.MaxAliases {
+			errs = append(errs, fmt.Errorf(
+				"The %s uses %d aliases, which exceeds the maximum of %d",
+				name, stats.Aliases, limits.MaxAliases,
+			))
+		}
+		if limits.MaxComplexity > 0 && stats.Complexity > limits.MaxComplexity {
+			errs = append(errs, fmt.Errorf(
+				"The %s has a complexity of %d, which exceeds the maximum complexity of %d",
+				name, stats.Complexity, limits.MaxComplexity,
+			))
+		}
+	}
+
+	return errs
+}
+
+// Stats calculates the depth, number of root fields and aliases and
+// the complexity of an operation in a document.
+func (limits *QueryLimits) Stats(
+	schema *graphql.Schema,
+	document *ast.Document,
+	def *ast.OperationDefinition,
+) QueryStats {
+	walker := &queryLimitsWalker{
+		limits:         limits,
+		schema:         schema,
+		fragments:      fragmentDefinitions(document),
+		visiting:       make(map[string]bool),
+		fragmentStats:  make(map[string]fragmentStats),
+		fragmentFields: make(map[string]int),
+	}
+
+	// Resolve the root type of the operation; missing root types are
+	// nil pointers that must not end up in the graphql.Type interface
+	var root graphql.Type
+	if schema != nil {
+		var object *graphql.Object
+		switch def.Operation {
+		case "query":
+			object = schema.QueryType()
+		case "mutation":
+			object = schema.MutationType()
+		case "subscription":
+			object = schema.SubscriptionType()
+		}
+		if object != nil {
+			root = object
+		}
+	}
+
+	stats := QueryStats{}
+	stats.RootFields = walker.countFields(def.GetSelectionSet())
+	stats.Depth, stats.Complexity = walker.walk(root, def.GetSelectionSet(), 1)
+	stats.Aliases = walker.aliases
+	return stats
+}
+
+func (limits *QueryLimits) fieldCost(typeName string, fieldName string) int {
+	if cost, ok := limits.FieldCosts[typeName+"."+fieldName]; ok {
+		return cost
+	}
+	if limits.DefaultFieldCost > 0 {
+		return limits.DefaultFieldCost
+	}
+	return 1
+}
+
+// Largest value of an int; stats saturate at it rather than overflow
+const maxInt = int(^uint(0) >> 1)
+
+// saturatingAdd adds two numbers, saturating instead of overflowing.
+func saturatingAdd(a, b int) int {
+	if b > 0 && a > maxInt-b {
+		return maxInt
+	}
+	return a + b
+}
+
+// fragmentStats are the stats of walking a fragment, with the depth
+// relative to where it is spread.
+type fragmentStats struct {
+	depth      int
+	complexity int
+	aliases    int
+}
+
+type queryLimitsWalker struct {
+	limits    *QueryLimits
+	schema    *graphql.Schema
+	fragments map[string]*ast.FragmentDefinition
+	visiting  map[string]bool
+	aliases   int
+
+	// Fragments are only walked once, as fragments spreading other
+	// fragments repeatedly would otherwise take exponential time
+	fragmentStats  map[string]fragmentStats
+	fragmentFields map[string]int
+}
+
+// countFields counts the fields of a selection set, including the
+// fields selected through fragments.
+func (w *queryLimitsWalker) countFields(set *ast.SelectionSet) int {
+	if set == nil {
+		return 0
+	}
+
+	count := 0
+	for _, selection := range set.Selections {
+		switch selection := selection.(type) {
+		case *ast.Field:
+			count++
+		case *ast.InlineFragment:
+			count += w.countFields(selection.SelectionSet)
+		case *ast.FragmentSpread:
+			name := selection.Name.Value
+			fields, ok := w.fragmentFields[name]
+			if !ok {
+				fragment, entered := w.enterFragment(selection)
+				if !entered {
+					continue
+				}
+				fields = w.countFields(fragment.SelectionSet)
+				w.leaveFragment(selection)
+				w.fragmentFields[name] = fields
+			}
+			count = saturatingAdd(count, fields)
+		}
+	}
+	return count
+}
+
+// walk returns the depth and complexity of a selection set on a type.
+func (w *queryLimitsWalker) walk(
+	parent graphql.Type,
+	set *ast.SelectionSet,
+	depth int,
+) (int, int) {
+	if set == nil {
+		return depth - 1, 0
+	}
+
+	maxDepth, complexity := depth, 0
+	for _, selection := range set.Selections {
+		var selectionDepth, selectionComplexity int
+
+		switch selection := selection.(type) {
+		case *ast.Field:
+			if selection.Alias != nil {
+				w.aliases = saturatingAdd(w.aliases, 1)
+			}
+			typeName, fieldType := w.fieldType(parent, selection.Name.Value)
+			selectionDepth, selectionComplexity = w.walk(fieldType, selection.SelectionSet, depth+1)
+			selectionComplexity = saturatingAdd(selectionComplexity, w.limits.fieldCost(typeName, selection.Name.Value))
+		case *ast.InlineFragment:
+			fragmentType := parent
+			if selection.TypeCondition != nil && w.schema != nil {
+				fragmentType = w.schema.Type(selection.TypeCondition.Name.Value)
+			}
+			selectionDepth, selectionComplexity = w.walk(fragmentType, selection.SelectionSet, depth)
+		case *ast.FragmentSpread:
+			var ok bool
+			selectionDepth, selectionComplexity, ok = w.walkFragment(parent, selection, depth)
+			if !ok {
+				continue
+			}
+		}
+
+		if selectionDepth > maxDepth {
+			maxDepth = selectionDepth
+		}
+		complexity = saturatingAdd(complexity, selectionComplexity)
+	}
+
+	return maxDepth, complexity
+}
+
+// walkFragment returns the depth and complexity of a fragment spread
+// on a type, walking each fragment only once per type.
+func (w *queryLimitsWalker) walkFragment(
+	parent graphql.Type,
+	spread *ast.FragmentSpread,
+	depth int,
+) (int, int, bool) {
+	fragment, ok := w.enterFragment(spread)
+	if !ok {
+		return 0, 0, false
+	}
+	defer w.leaveFragment(spread)
+
+	fragmentType := parent
+	if fragment.TypeCondition != nil && w.schema != nil {
+		fragmentType = w.schema.Type(fragment.TypeCondition.Name.Value)
+	}
+	key := spread.Name.Value
+	if fragmentType != nil {
+		key += " on " + fragmentType.Name()
+	}
+
+	if stats, ok := w.fragmentStats[key]; ok {
+		w.aliases = saturatingAdd(w.aliases, stats.aliases)
+		return depth + stats.depth, stats.complexity, true
+	}
+
+	aliases := w.aliases
+	fragmentDepth, complexity := w.walk(fragmentType, fragment.SelectionSet, depth)
+	w.fragmentStats[key] = fragmentStats{
+		depth:      fragmentDepth - depth,
+		complexity: complexity,
+		aliases:    w.aliases - aliases,
+	}
+	return fragmentDepth, complexity, true
+}
+
+// fieldType returns the name of the parent type and the type of the
+// given field, if it can be resolved in the schema.
+func (w *queryLimitsWalker) fieldType(parent graphql.Type, name string) (string, graphql.Type) {
+	var fields graphql.FieldDefinitionMap
+
+	switch parent := parent.(type) {
+	case *graphql.Object:
+		fields = parent.Fields()
+	case *graphql.Interface:
+		fields = parent.Fields()
+	default:
+		if parent != nil {
+			return parent.Name(), nil
+		}
+		return "", nil
+	}
+
+	if field, ok := fields[name]; ok {
+		named, _ := graphql.GetNamed(field.Type).(graphql.Type)
+		return parent.Name(), named
+	}
+	return parent.Name(), nil
+}
+
+// enterFragment looks up the definition of a fragment spread, guarding
+// against fragment cycles.
+func (w *queryLimitsWalker) enterFragment(spread *ast.FragmentSpread) (*ast.FragmentDefinition, bool) {
+	name := spread.Name.Value
+	fragment, ok := w.fragments[name]
+	if !ok || w.visiting[name] {
+		return nil, false
+	}
+	w.visiting[name] = true
+	return fragment, true
+}
+
+func (w *queryLimitsWalker) leaveFragment(spread *ast.FragmentSpread) {
+	delete(w.visiting, spread.Name.Value)
+}
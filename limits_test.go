@@ -0,0 +1,240 @@
+package graphqlws_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+func buildLimitsSchema() *graphql.Schema {
+	user := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{
+				Type: graphql.String,
+			},
+		},
+	})
+	user.AddFieldConfig("friends", &graphql.Field{
+		Type: graphql.NewList(user),
+	})
+
+	schema, _ := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"hello": &graphql.Field{
+					Type: graphql.String,
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"users": &graphql.Field{
+					Type: graphql.NewList(user),
+				},
+				"count": &graphql.Field{
+					Type: graphql.Int,
+				},
+			},
+		})})
+	return &schema
+}
+
+func TestLimits_StatsAreCalculatedCorrectly(t *testing.T) {
+	schema := buildLimitsSchema()
+	document, err := parser.Parse(parser.ParseParams{
+		Source: `
+			subscription {
+				users { ...UserFields }
+				total: count
+			}
+			fragment UserFields on User {
+				name
+				friends { name }
+			}
+		`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := &graphqlws.QueryLimits{
+		FieldCosts: map[string]int{"Subscription.users": 10},
+	}
+	def := document.Definitions[0].(*ast.OperationDefinition)
+	stats := limits.Stats(schema, document, def)
+
+	expected := graphqlws.QueryStats{
+		Depth:      3,
+		RootFields: 2,
+		Aliases:    1,
+		Complexity: 10 + 1 + 1 + 1 + 1,
+	}
+	if stats != expected {
+		t.Errorf("Stats returns %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestLimits_FragmentsSpreadRepeatedlyAreWalkedOnce(t *testing.T) {
+	// Each fragment spreads the next one twice, doubling the cost of
+	// walking them naively
+	source := "subscription { users { ...F0 } }\n"
+	for i := 0; i < 100; i++ {
+		source += fmt.Sprintf("fragment F%d on User { ...F%d ...F%d }\n", i, i+1, i+1)
+	}
+	source += "fragment F100 on User { name }"
+
+	document, err := parser.Parse(parser.ParseParams{Source: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := &graphqlws.QueryLimits{}
+	def := document.Definitions[0].(*ast.OperationDefinition)
+	stats := limits.Stats(buildLimitsSchema(), document, def)
+	if stats.Depth != 2 || stats.Complexity < 1<<40 {
+		t.Errorf("Stats returns %+v, expected a depth of 2 and a saturated complexity", stats)
+	}
+}
+
+func TestLimits_SubscriptionsExceedingLimitsAreRejected(t *testing.T) {
+	schema := buildLimitsSchema()
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema: schema,
+		Limits: &graphqlws.QueryLimits{
+			MaxDepth:      2,
+			MaxRootFields: 1,
+			MaxAliases:    0,
+			MaxComplexity: 5,
+		},
+	})
+
+	conn := mockWebSocketConnection{id: "1"}
+	subscribe := func(id string, query string) []error {
+		return sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      query,
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+
+	if errors := subscribe("1", "subscription { users { name } }"); len(errors) > 0 {
+		t.Error("AddSubscription rejects subscriptions within limits:", errors)
+	}
+
+	if errors := subscribe("2", "subscription { users { friends { name } } }"); len(errors) != 1 {
+		t.Error("AddSubscription does not reject subscriptions that are too deep:", errors)
+	}
+
+	if errors := subscribe("3", "subscription { count users { name } }"); len(errors) != 1 {
+		t.Error("AddSubscription does not reject too many root fields:", errors)
+	}
+
+	if errors := subscribe("4", "subscription { users { a: name b: name c: name d: name e: name } }"); len(errors) != 1 {
+		t.Error("AddSubscription does not reject subscriptions that are too complex:", errors)
+	}
+
+	if len(sm.Subscriptions()[&conn]) != 1 {
+		t.Error("AddSubscription adds subscriptions exceeding limits")
+	}
+}
+
+func TestLimits_ActiveOperationsAreLimited(t *testing.T) {
+	schema := buildLimitsSchema()
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema: schema,
+		OperationLimits: &graphqlws.OperationLimits{
+			MaxPerConnection: 2,
+			MaxPerUser:       3,
+			MaxTotal:         4,
+		},
+	})
+
+	subscribe := func(conn *mockWebSocketConnection, id string) []error {
+		return sm.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: conn,
+			Query:      "subscription { count }",
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+
+	conn1 := mockWebSocketConnection{id: "1", user: "alice"}
+	conn2 := mockWebSocketConnection{id: "2", user: "alice"}
+	conn3 := mockWebSocketConnection{id: "3", user: "bob"}
+
+	subscribe(&conn1, "1")
+	subscribe(&conn1, "2")
+	if errors := subscribe(&conn1, "3"); len(errors) != 1 ||
+		errors[0] != graphqlws.ErrConnectionOperationLimit {
+		t.Error("AddSubscription does not limit operations per connection:", errors)
+	}
+
+	subscribe(&conn2, "1")
+	if errors := subscribe(&conn2, "2"); len(errors) != 1 ||
+		errors[0] != graphqlws.ErrUserOperationLimit {
+		t.Error("AddSubscription does not limit operations per user:", errors)
+	}
+
+	subscribe(&conn3, "1")
+	if errors := subscribe(&conn3, "2"); len(errors) != 1 ||
+		errors[0] != graphqlws.ErrGlobalOperationLimit {
+		t.Error("AddSubscription does not limit operations overall:", errors)
+	}
+
+	// Removing subscriptions makes room for new ones
+	sm.RemoveSubscriptions(&conn1)
+	if errors := subscribe(&conn2, "2"); len(errors) > 0 {
+		t.Error("AddSubscription does not free up removed operations:", errors)
+	}
+
+	// Operations are freed up for the user they were counted for, even
+	// if the connection was initialized as another user since
+	conn2.user = "carol"
+	sm.RemoveSubscriptions(&conn2)
+	conn4 := mockWebSocketConnection{id: "4", user: "alice"}
+	for _, id := range []string{"1", "2"} {
+		if errors := subscribe(&conn4, id); len(errors) > 0 {
+			t.Error("AddSubscription does not free up operations of previous users:", errors)
+		}
+	}
+}
+
+func TestLimits_StartingOperationsIsRateLimited(t *testing.T) {
+	schema := buildLimitsSchema()
+	sm := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema: schema,
+		OperationLimits: &graphqlws.OperationLimits{
+			StartsPerSecond: 0.001,
+			StartBurst:      2,
+		},
+	})
+
+	conn := mockWebSocketConnection{id: "1"}
+	var errors []error
+	for _, id := range []string{"1", "2", "3"} {
+		errors = sm.AddSubscription(&conn, &graphqlws.Subscription{
+			ID:         id,
+			Connection: &conn,
+			Query:      "subscription { count }",
+			SendData: func(msg *graphqlws.DataMessagePayload) {
+				// Do nothing
+			},
+		})
+	}
+
+	if len(errors) != 1 || errors[0] != graphqlws.ErrStartRateLimit {
+		t.Error("AddSubscription does not rate limit starting operations:", errors)
+	}
+}
@@ -0,0 +1,175 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Boundary between the parts of multipart subscription responses
+	multipartBoundary = "graphql"
+
+	// Content type of multipart subscription responses
+	multipartContentType = `multipart/mixed;boundary="` + multipartBoundary + `";subscriptionSpec=1.0`
+
+	// Default interval of heartbeats on open multipart responses
+	multipartHeartbeat = 5 * time.Second
+)
+
+// MultipartHandlerConfig stores the configuration of a handler that
+// serves subscriptions over HTTP multipart responses.
+type MultipartHandlerConfig struct {
+	SubscriptionManager SubscriptionManager
+	Authenticate        AuthenticateFunc
+
+	// AuthToken extracts the token passed to Authenticate from a request;
+	// defaults to the bearer token of the Authorization header.
+	AuthToken func(*http.Request) string
+
+	// PersistedQueries enables support for automatic persisted queries.
+	PersistedQueries *PersistedQueryConfig
+
+	// MaxBodySize limits the size of request bodies; defaults to 1 MiB.
+	MaxBodySize int64
+
+	// Heartbeat is the interval at which empty parts are sent to keep
+	// responses from being closed by proxies; defaults to 5 seconds.
+	Heartbeat time.Duration
+}
+
+// NewMultipartHandler creates an HTTP handler that serves subscriptions
+// as incremental multipart/mixed responses, as supported by Apollo
+// Client. Each POST request starts one subscription, whose results are
+// sent as JSON parts of the response until the client disconnects.
+func NewMultipartHandler(config MultipartHandlerConfig) http.Handler {
+	if config.AuthToken == nil {
+		config.AuthToken = bearerToken
+	}
+	if config.Heartbeat <= 0 {
+		config.Heartbeat = multipartHeartbeat
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+
+	logger := NewLogger("multipart")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeErrorsResponse(w, http.StatusMethodNotAllowed, []error{errors.New("Method not allowed")})
+			return
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "multipart/mixed") {
+			writeErrorsResponse(w, http.StatusNotAcceptable, []error{errors.New("Multipart response not accepted")})
+			return
+		}
+
+		user, err := authenticateRequest(config.Authenticate, config.AuthToken, r)
+		if err != nil {
+			writeErrorsResponse(w, http.StatusUnauthorized, []error{err})
+			return
+		}
+
+		data, _, err := readOperationRequest(w, r, config.MaxBodySize)
+		if err != nil {
+			writeErrorsResponse(w, http.StatusBadRequest, []error{err})
+			return
+		}
+
+		// There is only one operation per connection, so the connection ID
+		// doubles as the operation ID
+		conn := newMultipartConnection(user)
+
+		logger.WithFields(log.Fields{
+			"conn": conn.ID(),
+			"user": conn.User(),
+		}).Debug("Start operation")
+
+		// The connection is indexed first, so that results published
+		// right away reach it
+		AddConnection(config.SubscriptionManager, conn)
+		if errs := startOperation(config.SubscriptionManager, config.PersistedQueries, conn, conn.ID(), data); len(errs) > 0 {
+			RemoveConnection(config.SubscriptionManager, conn)
+			writeErrorsResponse(w, http.StatusBadRequest, errs)
+			return
+		}
+
+		defer func() {
+			conn.close()
+			config.SubscriptionManager.RemoveSubscriptions(conn)
+			RemoveConnection(config.SubscriptionManager, conn)
+		}()
+
+		w.Header().Set("Content-Type", multipartContentType)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		conn.serve(w, r, config.Heartbeat, multipartPart([]byte("{}")))
+	})
+}
+
+// multipartPart formats a JSON document as a part of a multipart
+// response; each part is followed by the boundary, so that clients can
+// process it right away.
+func multipartPart(data []byte) []byte {
+	part := "Content-Type: application/json; charset=utf-8\r\n\r\n" +
+		string(data) + "\r\n--" + multipartBoundary + "\r\n"
+	return []byte(part)
+}
+
+/**
+ * An implementation of the Connection interface for multipart clients.
+ */
+
+type multipartConnection struct {
+	httpStream
+
+	id   string
+	user interface{}
+}
+
+func newMultipartConnection(user interface{}) *multipartConnection {
+	conn := new(multipartConnection)
+	conn.id = uuid.New().String()
+	conn.user = user
+	conn.httpStream = newHTTPStream(NewLogger("multipart/" + conn.id))
+
+	// The response starts with a boundary that precedes the first part
+	conn.write([]byte("\r\n--" + multipartBoundary + "\r\n"))
+	return conn
+}
+
+func (conn *multipartConnection) ID() string {
+	return conn.id
+}
+
+func (conn *multipartConnection) User() interface{} {
+	return conn.user
+}
+
+func (conn *multipartConnection) SendData(opID string, data *DataMessagePayload) {
+	conn.sendPart(map[string]interface{}{"payload": data})
+}
+
+// SendError sends a transport error, which ends the subscription for
+// Apollo clients.
+func (conn *multipartConnection) SendError(err error) {
+	conn.sendPart(map[string]interface{}{
+		"payload": nil,
+		"errors":  errorsForPayload([]error{err}, nil),
+	})
+}
+
+func (conn *multipartConnection) sendPart(payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		conn.logger.WithField("err", err).Warn("Failed to encode part")
+		return
+	}
+	conn.write(multipartPart(data))
+}
@@ -0,0 +1,153 @@
+package graphqlws_test
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+)
+
+func TestMultipartHandler_StreamsDataAndHeartbeats(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	srv := httptest.NewServer(graphqlws.NewMultipartHandler(graphqlws.MultipartHandlerConfig{
+		SubscriptionManager: manager,
+		Heartbeat:           20 * time.Millisecond,
+	}))
+	defer srv.Close()
+
+	post := func(query string) *http.Response {
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(`{"query": "`+query+`"}`))
+		req.Header.Set("Accept", `multipart/mixed;subscriptionSpec="1.0", application/json`)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := post("subscription { unknown }")
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Invalid operation is not rejected:", res.Status)
+	}
+
+	res = post("subscription { greeting }")
+	defer res.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatal("Unexpected content type:", res.Header.Get("Content-Type"))
+	}
+
+	publishGreeting(t, manager, 1)
+
+	reader := multipart.NewReader(res.Body, params["boundary"])
+	heartbeats := 0
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal("Failed to read part:", err)
+		}
+		body, _ := ioutil.ReadAll(part)
+		if string(body) == "{}" {
+			heartbeats++
+			continue
+		}
+		if string(body) != `{"payload":{"data":{"greeting":"hello"},"errors":null}}` {
+			t.Fatal("Unexpected part:", string(body))
+		}
+		break
+	}
+
+	// Heartbeats keep coming after the data
+	for heartbeats == 0 {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal("Failed to read part:", err)
+		}
+		if body, _ := ioutil.ReadAll(part); string(body) == "{}" {
+			heartbeats++
+		}
+	}
+
+	// Disconnecting removes the subscription
+	res.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.Subscriptions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription is not removed when the client disconnects")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMultipartHandler_StalledClientsDoNotBlockPublishers(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	srv := httptest.NewServer(graphqlws.NewMultipartHandler(graphqlws.MultipartHandlerConfig{
+		SubscriptionManager: manager,
+	}))
+	defer srv.Close()
+
+	// The client starts the subscription, but never reads the response
+	req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(`{"query": "subscription { greeting }"}`))
+	req.Header.Set("Accept", `multipart/mixed;subscriptionSpec="1.0", application/json`)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		greeting := strings.Repeat("x", 64*1024)
+		for i := 0; i < 500; i++ {
+			publishGreetingValue(t, manager, 0, greeting)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publishing is blocked by a stalled client")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.Subscriptions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Stalled client is not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMultipartHandler_RequestBodiesAreLimited(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	post := func(config graphqlws.MultipartHandlerConfig) *http.Response {
+		config.SubscriptionManager = manager
+		srv := httptest.NewServer(graphqlws.NewMultipartHandler(config))
+		defer srv.Close()
+
+		// Queries longer than WebSocket messages are fine
+		query := "subscription {" + strings.Repeat(" ", 8000) + "greeting }"
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(`{"query": "`+query+`"}`))
+		req.Header.Set("Accept", `multipart/mixed;subscriptionSpec="1.0", application/json`)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := post(graphqlws.MultipartHandlerConfig{}); res.StatusCode != http.StatusOK {
+		t.Error("Long query is rejected:", res.Status)
+	}
+	if res := post(graphqlws.MultipartHandlerConfig{MaxBodySize: 1024}); res.StatusCode != http.StatusBadRequest {
+		t.Error("Request body exceeding the limit is not rejected:", res.Status)
+	}
+}
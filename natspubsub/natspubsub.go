@@ -0,0 +1,162 @@
+// Package natspubsub implements graphqlws.PubSub on top of NATS, so that
+// events published by any server instance reach the subscribers
+// connected to all instances:
+//
+//	nc, err := nats.Connect(nats.DefaultURL)
+//
+//	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+//		Schema: &schema,
+//		PubSub: natspubsub.NewPubSub(natspubsub.Config{Conn: nc}),
+//		Topic:  natspubsub.Subject,
+//	})
+//
+// Topics are used as NATS subjects, so they may form hierarchies of
+// dot-separated tokens; Subject derives such hierarchies from
+// subscription fields and arguments. Payloads are sent as JSON, so
+// handlers receive them as decoded JSON values. Messages that are not
+// valid JSON, e.g. published by other tools, are passed on as strings.
+//
+// Reconnecting to the NATS server, and resubscribing afterwards, is
+// handled by the NATS connection.
+package natspubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/nats-io/nats.go"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config defines the configuration parameters of a NATS PubSub.
+type Config struct {
+	// Conn is the NATS connection used for publishing and subscribing.
+	Conn *nats.Conn
+
+	// Prefix is prepended to topics to form subjects, e.g. "graphql."
+	// to publish all events below a common subject.
+	Prefix string
+
+	// Logger is used for logging; defaults to a "nats" logger.
+	Logger *log.Entry
+}
+
+// PubSub is a graphqlws.PubSub backed by NATS.
+type PubSub interface {
+	graphqlws.PubSub
+
+	// QueueSubscribe subscribes a handler to a topic as a member of a
+	// queue group; each payload is delivered to only one member of the
+	// group, across all instances, which makes members competing
+	// consumers. Topics may contain the wildcards "*" and ">".
+	QueueSubscribe(topic string, queue string, handler graphqlws.PubSubHandler) (unsubscribe func(), err error)
+}
+
+/**
+ * The default implementation of the PubSub interface.
+ */
+
+type pubsub struct {
+	conn   *nats.Conn
+	prefix string
+	logger *log.Entry
+}
+
+// NewPubSub creates a PubSub that publishes to and subscribes to NATS
+// subjects. Topics may contain the wildcards "*" and ">" when
+// subscribing.
+func NewPubSub(config Config) PubSub {
+	ps := &pubsub{
+		conn:   config.Conn,
+		prefix: config.Prefix,
+		logger: config.Logger,
+	}
+	if ps.logger == nil {
+		ps.logger = graphqlws.NewLogger("nats")
+	}
+	return ps
+}
+
+func (ps *pubsub) Publish(topic string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return ps.conn.Publish(ps.prefix+topic, data)
+}
+
+func (ps *pubsub) Subscribe(topic string, handler graphqlws.PubSubHandler) (func(), error) {
+	return ps.QueueSubscribe(topic, "", handler)
+}
+
+func (ps *pubsub) QueueSubscribe(topic string, queue string, handler graphqlws.PubSubHandler) (func(), error) {
+	subscription, err := ps.conn.QueueSubscribe(ps.prefix+topic, queue, func(msg *nats.Msg) {
+		var payload interface{}
+		if err := json.Unmarshal(msg.Data, &payload); err != nil {
+			payload = string(msg.Data)
+		}
+		handler(strings.TrimPrefix(msg.Subject, ps.prefix), payload)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the server knows about the subscription before events
+	// are published for it
+	if err := ps.conn.Flush(); err != nil {
+		subscription.Unsubscribe()
+		return nil, err
+	}
+
+	return func() {
+		if err := subscription.Unsubscribe(); err != nil && err != nats.ErrConnectionClosed {
+			ps.logger.WithFields(log.Fields{
+				"subject": subscription.Subject,
+				"err":     err,
+			}).Warn("Failed to unsubscribe")
+		}
+	}, nil
+}
+
+// Subject is a graphqlws.TopicFunc that derives a subject hierarchy
+// from a field and its arguments, ordered by name, e.g.
+// "messageAdded.channel.general" for messageAdded(channel: "general").
+// Characters that have a special meaning in subjects, as well as
+// underscores, are escaped as an underscore followed by their hex code,
+// e.g. "general.*" becomes "general_2E_2A", so that distinct arguments
+// never share a subject.
+func Subject(field string, args map[string]interface{}) string {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tokens := []string{subjectToken(field)}
+	for _, name := range names {
+		tokens = append(tokens, subjectToken(name), subjectToken(fmt.Sprint(args[name])))
+	}
+	return strings.Join(tokens, ".")
+}
+
+// subjectToken escapes a string into a subject token; empty strings
+// become a single underscore, which escaped strings never are.
+func subjectToken(s string) string {
+	if s == "" {
+		return "_"
+	}
+
+	var token strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '_' || c == '.' || c == '*' || c == '>' || c <= ' ' || c == 0x7f:
+			fmt.Fprintf(&token, "_%02X", c)
+		default:
+			token.WriteByte(c)
+		}
+	}
+	return token.String()
+}
@@ -0,0 +1,151 @@
+package natspubsub_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/functionalfoundry/graphqlws/natspubsub"
+	"github.com/graphql-go/graphql"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+func newPubSub(t *testing.T, server *natsserver.Server) natspubsub.PubSub {
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+	return natspubsub.NewPubSub(natspubsub.Config{Conn: nc, Prefix: "graphql."})
+}
+
+func TestSubject(t *testing.T) {
+	subject := natspubsub.Subject("messageAdded", map[string]interface{}{
+		"priority": 1,
+		"channel":  "general.*",
+	})
+	if subject != "messageAdded.channel.general_2E_2A.priority.1" {
+		t.Error("Unexpected subject:", subject)
+	}
+	if subject := natspubsub.Subject("greeting", nil); subject != "greeting" {
+		t.Error("Unexpected subject:", subject)
+	}
+
+	// Distinct arguments never share a subject
+	seen := map[string]string{}
+	for _, value := range []string{"a.b", "a_b", "a_2Eb", "a b", "", "_"} {
+		subject := natspubsub.Subject("messageAdded", map[string]interface{}{"channel": value})
+		if other, ok := seen[subject]; ok {
+			t.Errorf("%q and %q share subject %q", value, other, subject)
+		}
+		seen[subject] = value
+	}
+}
+
+func TestPubSub_DeliversAcrossInstances(t *testing.T) {
+	server := runTestServer(t)
+
+	message := graphql.NewObject(graphql.ObjectConfig{
+		Name:   "Message",
+		Fields: graphql.Fields{"text": &graphql.Field{Type: graphql.String}},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{"messageAdded": &graphql.Field{
+				Type: message,
+				Args: graphql.FieldConfigArgument{"channel": &graphql.ArgumentConfig{Type: graphql.String}},
+			}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client connects to one instance, while the event is published
+	// on another one
+	publisher := newPubSub(t, server)
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema: &schema,
+		PubSub: newPubSub(t, server),
+		Topic:  natspubsub.Subject,
+	})
+	defer bridge.Close()
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{SubscriptionManager: bridge})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Init(nil)
+	client.ExpectAck()
+	client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+
+	publisher.Publish("messageAdded.channel.random", map[string]interface{}{"text": "ignored"})
+	publisher.Publish("messageAdded.channel.general", map[string]interface{}{"text": "hello"})
+	client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "hello"}}`))
+}
+
+func TestPubSub_QueueGroupsCompete(t *testing.T) {
+	server := runTestServer(t)
+	publisher := newPubSub(t, server)
+
+	var mutex sync.Mutex
+	received := map[string]int{}
+	handler := func(name string) graphqlws.PubSubHandler {
+		return func(topic string, payload interface{}) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			received[name]++
+			received[fmt.Sprint(payload)]++
+		}
+	}
+
+	// Two workers compete for events, while a plain subscriber gets all
+	// of them
+	for _, name := range []string{"worker1", "worker2"} {
+		if _, err := newPubSub(t, server).QueueSubscribe("jobs.>", "workers", handler(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unsubscribe, err := newPubSub(t, server).Subscribe("jobs.*", handler("observer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsubscribe()
+
+	for i := 0; i < 20; i++ {
+		publisher.Publish("jobs.resize", i)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		done := received["observer"] == 20 && received["worker1"]+received["worker2"] == 20
+		mutex.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Unexpected deliveries:", received)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := 0; i < 20; i++ {
+		if received[fmt.Sprint(i)] != 2 {
+			t.Errorf("Job %d is delivered %d times", i, received[fmt.Sprint(i)])
+		}
+	}
+}
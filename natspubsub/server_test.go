@@ -0,0 +1,18 @@
+package natspubsub_test
+
+import (
+	"testing"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	natstest "github.com/nats-io/nats-server/v2/test"
+)
+
+// runTestServer starts an embedded NATS server on a random port, which
+// is shut down at the end of the test.
+func runTestServer(t *testing.T) *natsserver.Server {
+	opts := natstest.DefaultTestOptions
+	opts.Port = natsserver.RANDOM_PORT
+	server := natstest.RunServer(&opts)
+	t.Cleanup(server.Shutdown)
+	return server
+}
@@ -0,0 +1,234 @@
+package graphqlws
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// PersistedQueryError is an error that occurs while resolving an
+// automatic persisted query. It is encoded the way Apollo clients
+// expect, so that they can retry with the full query text.
+type PersistedQueryError struct {
+	Message string
+	Code    string
+}
+
+func (err *PersistedQueryError) Error() string {
+	return err.Message
+}
+
+// MarshalJSON encodes the error as a GraphQL error with an
+// extensions.code field.
+func (err *PersistedQueryError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"message": err.Message,
+		"extensions": map[string]interface{}{
+			"code": err.Code,
+		},
+	})
+}
+
+var (
+	// ErrPersistedQueryNotFound is returned if a client references a
+	// persisted query by hash that the server does not know (yet).
+	ErrPersistedQueryNotFound = &PersistedQueryError{
+		Message: "PersistedQueryNotFound",
+		Code:    "PERSISTED_QUERY_NOT_FOUND",
+	}
+
+	// ErrPersistedQueryNotSupported is returned if a client sends a
+	// persisted query but the server is not configured to support them.
+	ErrPersistedQueryNotSupported = &PersistedQueryError{
+		Message: "PersistedQueryNotSupported",
+		Code:    "PERSISTED_QUERY_NOT_SUPPORTED",
+	}
+
+	// ErrPersistedQueryHashMismatch is returned if the query sent by
+	// a client does not match the hash it was sent with.
+	ErrPersistedQueryHashMismatch = &PersistedQueryError{
+		Message: "provided sha does not match query",
+		Code:    "INTERNAL_SERVER_ERROR",
+	}
+
+	// ErrPersistedQueryNotAllowed is returned in strict mode if a client
+	// sends a query that has not been registered in advance.
+	ErrPersistedQueryNotAllowed = &PersistedQueryError{
+		Message: "PersistedQueryNotAllowed",
+		Code:    "PERSISTED_QUERY_NOT_ALLOWED",
+	}
+)
+
+// PersistedQueryStore stores the query texts of automatic persisted
+// queries by their SHA-256 hashes.
+type PersistedQueryStore interface {
+	// Get returns the query for a hash, if it is known.
+	Get(hash string) (string, bool)
+
+	// Put stores a query under its hash.
+	Put(hash string, query string) error
+}
+
+// PersistedQueryConfig defines how automatic persisted queries are
+// resolved.
+type PersistedQueryConfig struct {
+	// Store is where persisted queries are looked up and registered.
+	Store PersistedQueryStore
+
+	// Strict only allows queries whose hashes have been registered in
+	// the store in advance; clients cannot register new queries.
+	Strict bool
+}
+
+// PersistedQueryHash returns the hex-encoded SHA-256 hash of a query,
+// as used by automatic persisted queries.
+func PersistedQueryHash(query string) string {
+	sum := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(sum[:])
+}
+
+// ResolvePersistedQuery fills in the query of a start message payload
+// from the persisted query store, or registers the query sent by the
+// client under its hash.
+func ResolvePersistedQuery(config *PersistedQueryConfig, data *StartMessagePayload) error {
+	var extension *PersistedQueryExtension
+	if data.Extensions != nil {
+		extension = data.Extensions.PersistedQuery
+	}
+
+	if config == nil || config.Store == nil {
+		if extension != nil {
+			return ErrPersistedQueryNotSupported
+		}
+		return nil
+	}
+
+	if extension == nil || extension.Sha256Hash == "" {
+		if config.Strict {
+			return ErrPersistedQueryNotAllowed
+		}
+		return nil
+	}
+
+	// Look up the query by hash if the client only sent the hash
+	if data.Query == "" {
+		query, ok := config.Store.Get(extension.Sha256Hash)
+		if !ok {
+			return ErrPersistedQueryNotFound
+		}
+		data.Query = query
+		return nil
+	}
+
+	if PersistedQueryHash(data.Query) != extension.Sha256Hash {
+		return ErrPersistedQueryHashMismatch
+	}
+
+	// In strict mode, only registered queries may be used
+	if config.Strict {
+		if _, ok := config.Store.Get(extension.Sha256Hash); !ok {
+			return ErrPersistedQueryNotAllowed
+		}
+		return nil
+	}
+
+	return config.Store.Put(extension.Sha256Hash, data.Query)
+}
+
+/**
+ * An in-memory implementation of the PersistedQueryStore interface.
+ */
+
+type memoryPersistedQueryStore struct {
+	mutex   sync.RWMutex
+	queries map[string]string
+}
+
+// NewMemoryPersistedQueryStore creates a persisted query store that
+// keeps queries in memory.
+func NewMemoryPersistedQueryStore() PersistedQueryStore {
+	store := new(memoryPersistedQueryStore)
+	store.queries = make(map[string]string)
+	return store
+}
+
+func (s *memoryPersistedQueryStore) Get(hash string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	query, ok := s.queries[hash]
+	return query, ok
+}
+
+func (s *memoryPersistedQueryStore) Put(hash string, query string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.queries[hash] = query
+	return nil
+}
+
+/**
+ * A file-backed implementation of the PersistedQueryStore interface.
+ */
+
+type filePersistedQueryStore struct {
+	memoryPersistedQueryStore
+	path string
+}
+
+// NewFilePersistedQueryStore creates a persisted query store that is
+// backed by a JSON file mapping hashes to queries. Existing queries are
+// loaded from the file if it exists; newly registered queries are
+// written back to it.
+func NewFilePersistedQueryStore(path string) (PersistedQueryStore, error) {
+	store := new(filePersistedQueryStore)
+	store.queries = make(map[string]string)
+	store.path = path
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(contents) > 0 {
+		if err := json.Unmarshal(contents, &store.queries); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func (s *filePersistedQueryStore) Put(hash string, query string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if existing, ok := s.queries[hash]; ok && existing == query {
+		return nil
+	}
+	s.queries[hash] = query
+
+	contents, err := json.MarshalIndent(s.queries, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that the store is never
+	// left in a corrupt state
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
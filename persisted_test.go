@@ -0,0 +1,113 @@
+package graphqlws_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/functionalfoundry/graphqlws"
+)
+
+func persistedQueryPayload(query string, hash string) *graphqlws.StartMessagePayload {
+	return &graphqlws.StartMessagePayload{
+		Query: query,
+		Extensions: &graphqlws.StartMessageExtensions{
+			PersistedQuery: &graphqlws.PersistedQueryExtension{
+				Version:    1,
+				Sha256Hash: hash,
+			},
+		},
+	}
+}
+
+func TestPersistedQueries_UnknownHashesAreNotFound(t *testing.T) {
+	config := &graphqlws.PersistedQueryConfig{
+		Store: graphqlws.NewMemoryPersistedQueryStore(),
+	}
+
+	query := "subscription { users }"
+	hash := graphqlws.PersistedQueryHash(query)
+
+	// Sending only the hash fails until the query has been registered
+	err := graphqlws.ResolvePersistedQuery(config, persistedQueryPayload("", hash))
+	if err != graphqlws.ErrPersistedQueryNotFound {
+		t.Fatal("ResolvePersistedQuery does not fail for unknown hashes:", err)
+	}
+
+	// Register the query by sending it along with its hash
+	err = graphqlws.ResolvePersistedQuery(config, persistedQueryPayload(query, hash))
+	if err != nil {
+		t.Fatal("ResolvePersistedQuery fails registering a query:", err)
+	}
+
+	// Now sending only the hash resolves the query
+	data := persistedQueryPayload("", hash)
+	err = graphqlws.ResolvePersistedQuery(config, data)
+	if err != nil || data.Query != query {
+		t.Error("ResolvePersistedQuery does not resolve registered hashes:", err)
+	}
+}
+
+func TestPersistedQueries_MismatchingHashesAreRejected(t *testing.T) {
+	config := &graphqlws.PersistedQueryConfig{
+		Store: graphqlws.NewMemoryPersistedQueryStore(),
+	}
+
+	data := persistedQueryPayload("subscription { users }", "abc")
+	err := graphqlws.ResolvePersistedQuery(config, data)
+	if err != graphqlws.ErrPersistedQueryHashMismatch {
+		t.Error("ResolvePersistedQuery accepts mismatching hashes:", err)
+	}
+}
+
+func TestPersistedQueries_StrictModeOnlyAllowsRegisteredQueries(t *testing.T) {
+	store := graphqlws.NewMemoryPersistedQueryStore()
+	config := &graphqlws.PersistedQueryConfig{Store: store, Strict: true}
+
+	query := "subscription { users }"
+	hash := graphqlws.PersistedQueryHash(query)
+
+	err := graphqlws.ResolvePersistedQuery(config, persistedQueryPayload(query, hash))
+	if err != graphqlws.ErrPersistedQueryNotAllowed {
+		t.Error("ResolvePersistedQuery registers queries in strict mode:", err)
+	}
+
+	err = graphqlws.ResolvePersistedQuery(config, &graphqlws.StartMessagePayload{Query: query})
+	if err != graphqlws.ErrPersistedQueryNotAllowed {
+		t.Error("ResolvePersistedQuery allows plain queries in strict mode:", err)
+	}
+
+	store.Put(hash, query)
+
+	data := persistedQueryPayload("", hash)
+	err = graphqlws.ResolvePersistedQuery(config, data)
+	if err != nil || data.Query != query {
+		t.Error("ResolvePersistedQuery rejects registered queries in strict mode:", err)
+	}
+}
+
+func TestPersistedQueries_FileStoreSurvivesRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphqlws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.json")
+	store, err := graphqlws.NewFilePersistedQueryStore(path)
+	if err != nil {
+		t.Fatal("NewFilePersistedQueryStore fails for a missing file:", err)
+	}
+	if err := store.Put("abc", "subscription { users }"); err != nil {
+		t.Fatal("FilePersistedQueryStore fails storing queries:", err)
+	}
+
+	store, err = graphqlws.NewFilePersistedQueryStore(path)
+	if err != nil {
+		t.Fatal("NewFilePersistedQueryStore fails loading queries:", err)
+	}
+	if query, ok := store.Get("abc"); !ok || query != "subscription { users }" {
+		t.Error("FilePersistedQueryStore does not load stored queries")
+	}
+}
@@ -0,0 +1,260 @@
+// Package pgnotify turns PostgreSQL notifications into subscription
+// events. An event source LISTENs on Postgres channels and publishes the
+// payload of every NOTIFY to a graphqlws.PubSub, typically the one of a
+// pub/sub bridge, which then executes the subscriptions of the topic:
+//
+//	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+//		Schema: &schema,
+//	})
+//
+//	source, err := pgnotify.NewEventSource(pgnotify.Config{
+//		ConnString: "postgres://localhost/app?sslmode=disable",
+//		Channels:   []string{"messageAdded"},
+//		PubSub:     bridge.PubSub(),
+//	})
+//	defer source.Close()
+//
+// Postgres limits NOTIFY payloads to 8000 bytes. Notify refuses larger
+// payloads up front; for large rows, notify with the row's key and
+// configure Load to fetch the row when the notification arrives.
+package pgnotify
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxPayloadSize is the maximum size of NOTIFY payloads in bytes.
+	MaxPayloadSize = 7999
+
+	// Default bounds of the delay between reconnection attempts
+	defaultMinReconnectInterval = 100 * time.Millisecond
+	defaultMaxReconnectInterval = 30 * time.Second
+)
+
+// ErrPayloadTooLarge is returned by Notify for payloads that exceed
+// the size limit of Postgres notifications.
+var ErrPayloadTooLarge = errors.New("Notification payload exceeds the maximum size of 7999 bytes")
+
+// Listener receives notifications from Postgres; *pq.Listener implements
+// it. After reconnecting, a listener sends a nil notification, as
+// notifications may have been missed in the meantime.
+type Listener interface {
+	Listen(channel string) error
+	NotificationChannel() <-chan *pq.Notification
+	Close() error
+}
+
+// TopicFunc derives the topic a notification is published to from its
+// channel and decoded payload.
+type TopicFunc func(channel string, payload interface{}) string
+
+// LoadFunc loads the event of a notification from its decoded payload,
+// e.g. fetches a row by the key sent in the payload.
+type LoadFunc func(ctx context.Context, channel string, payload interface{}) (interface{}, error)
+
+// Config defines the configuration parameters of an event source.
+type Config struct {
+	// ConnString is the connection string of the Postgres database,
+	// used to create a listener unless Listener is set.
+	ConnString string
+
+	// Listener optionally receives notifications instead of a listener
+	// created for ConnString.
+	Listener Listener
+
+	// MinReconnectInterval and MaxReconnectInterval bound the delay
+	// between attempts to reconnect the listener created for ConnString;
+	// they default to 100ms and 30s.
+	MinReconnectInterval time.Duration
+	MaxReconnectInterval time.Duration
+
+	// Channels are the Postgres channels to LISTEN on.
+	Channels []string
+
+	// PubSub is the broker notifications are published to.
+	PubSub graphqlws.PubSub
+
+	// Topic derives the topic of notifications; defaults to the name
+	// of their channel.
+	Topic TopicFunc
+
+	// Load optionally loads the event of notifications, whose decoded
+	// payload is published otherwise.
+	Load LoadFunc
+
+	// OnReconnect is optionally called after the listener reconnected,
+	// e.g. to resynchronize subscribers that may have missed events.
+	OnReconnect func()
+
+	// Logger is used for logging; defaults to a "pgnotify" logger.
+	Logger *log.Entry
+}
+
+// EventSource publishes Postgres notifications until closed.
+type EventSource interface {
+	// Close stops listening and closes the listener.
+	Close() error
+}
+
+/**
+ * The default implementation of the EventSource interface.
+ */
+
+type eventSource struct {
+	config   Config
+	listener Listener
+	logger   *log.Entry
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewEventSource LISTENs on the configured channels and starts
+// publishing their notifications. Payloads are decoded as JSON; payloads
+// that are not valid JSON are published as strings.
+func NewEventSource(config Config) (EventSource, error) {
+	source := &eventSource{
+		config:   config,
+		listener: config.Listener,
+		logger:   config.Logger,
+		done:     make(chan struct{}),
+	}
+	if source.logger == nil {
+		source.logger = graphqlws.NewLogger("pgnotify")
+	}
+	if source.config.Topic == nil {
+		source.config.Topic = func(channel string, payload interface{}) string {
+			return channel
+		}
+	}
+	if source.listener == nil {
+		source.listener = source.newListener()
+	}
+
+	for _, channel := range config.Channels {
+		if err := source.listener.Listen(channel); err != nil {
+			source.listener.Close()
+			return nil, err
+		}
+	}
+
+	source.ctx, source.cancel = context.WithCancel(context.Background())
+	go source.receiveLoop()
+
+	return source, nil
+}
+
+// newListener creates a listener for the connection string, which
+// reconnects and listens on all channels again after connection
+// failures.
+func (source *eventSource) newListener() Listener {
+	minInterval := source.config.MinReconnectInterval
+	if minInterval <= 0 {
+		minInterval = defaultMinReconnectInterval
+	}
+	maxInterval := source.config.MaxReconnectInterval
+	if maxInterval < minInterval {
+		maxInterval = defaultMaxReconnectInterval
+	}
+
+	return pq.NewListener(source.config.ConnString, minInterval, maxInterval, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			source.logger.WithField("err", err).Warn("Disconnected from Postgres")
+		case pq.ListenerEventConnectionAttemptFailed:
+			source.logger.WithField("err", err).Warn("Failed to reconnect to Postgres")
+		case pq.ListenerEventReconnected:
+			source.logger.Info("Reconnected to Postgres")
+		}
+	})
+}
+
+func (source *eventSource) Close() error {
+	source.cancel()
+	err := source.listener.Close()
+	<-source.done
+	return err
+}
+
+func (source *eventSource) receiveLoop() {
+	defer close(source.done)
+
+	for {
+		select {
+		case <-source.ctx.Done():
+			return
+		case notification, ok := <-source.listener.NotificationChannel():
+			if !ok {
+				return
+			}
+
+			// Listeners send nil after reconnecting
+			if notification == nil {
+				if source.config.OnReconnect != nil {
+					source.config.OnReconnect()
+				}
+				continue
+			}
+
+			source.publish(notification)
+		}
+	}
+}
+
+// publish decodes a notification and publishes its event.
+func (source *eventSource) publish(notification *pq.Notification) {
+	logger := source.logger.WithField("channel", notification.Channel)
+
+	var payload interface{}
+	if err := json.Unmarshal([]byte(notification.Extra), &payload); err != nil {
+		payload = notification.Extra
+	}
+
+	event := payload
+	if source.config.Load != nil {
+		loaded, err := source.config.Load(source.ctx, notification.Channel, payload)
+		if err != nil {
+			logger.WithField("err", err).Warn("Failed to load notification event")
+			return
+		}
+		event = loaded
+	}
+
+	topic := source.config.Topic(notification.Channel, payload)
+	if err := source.config.PubSub.Publish(topic, event); err != nil {
+		logger.WithFields(log.Fields{
+			"topic": topic,
+			"err":   err,
+		}).Warn("Failed to publish notification")
+	}
+}
+
+// Execer executes statements; *sql.DB, *sql.Conn and *sql.Tx implement
+// it.
+type Execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// Notify sends a notification with a JSON-encoded payload on a channel,
+// using pg_notify. It returns ErrPayloadTooLarge, without contacting
+// the database, if the encoded payload exceeds MaxPayloadSize.
+func Notify(ctx context.Context, db Execer, channel string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxPayloadSize {
+		return ErrPayloadTooLarge
+	}
+	_, err = db.ExecContext(ctx, "SELECT pg_notify($1, $2)", channel, string(data))
+	return err
+}
@@ -0,0 +1,153 @@
+package pgnotify_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/pgnotify"
+	"github.com/lib/pq"
+)
+
+// testListener stands in for a *pq.Listener connected to Postgres.
+type testListener struct {
+	channels      []string
+	notifications chan *pq.Notification
+	closeOnce     sync.Once
+}
+
+func newTestListener() *testListener {
+	return &testListener{notifications: make(chan *pq.Notification)}
+}
+
+func (l *testListener) Listen(channel string) error {
+	if channel == "" {
+		return errors.New("Invalid channel")
+	}
+	l.channels = append(l.channels, channel)
+	return nil
+}
+
+func (l *testListener) NotificationChannel() <-chan *pq.Notification {
+	return l.notifications
+}
+
+func (l *testListener) Close() error {
+	l.closeOnce.Do(func() { close(l.notifications) })
+	return nil
+}
+
+func (l *testListener) notify(channel string, payload string) {
+	l.notifications <- &pq.Notification{Channel: channel, Extra: payload}
+}
+
+func TestEventSource_PublishesNotifications(t *testing.T) {
+	listener := newTestListener()
+	pubsub := graphqlws.NewInMemoryPubSub()
+	reconnected := make(chan bool, 1)
+
+	source, err := pgnotify.NewEventSource(pgnotify.Config{
+		Listener: listener,
+		Channels: []string{"message_added", "user_changed"},
+		PubSub:   pubsub,
+		Topic: func(channel string, payload interface{}) string {
+			if channel == "message_added" {
+				return fmt.Sprintf("messageAdded.%v", payload.(map[string]interface{})["channel"])
+			}
+			return channel
+		},
+		Load: func(ctx context.Context, channel string, payload interface{}) (interface{}, error) {
+			if channel == "user_changed" {
+				if payload == "missing" {
+					return nil, errors.New("User not found")
+				}
+				return map[string]interface{}{"id": payload, "name": "Alice"}, nil
+			}
+			return payload, nil
+		},
+		OnReconnect: func() { reconnected <- true },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+
+	if strings.Join(listener.channels, ",") != "message_added,user_changed" {
+		t.Error("Channels are not listened on:", listener.channels)
+	}
+
+	received := make(chan string, 10)
+	for _, topic := range []string{"messageAdded.general", "user_changed"} {
+		pubsub.Subscribe(topic, func(topic string, payload interface{}) {
+			received <- fmt.Sprint(topic, "=", payload)
+		})
+	}
+
+	listener.notify("message_added", `{"channel": "general", "text": "hello"}`)
+	listener.notify("user_changed", "missing")
+	listener.notify("user_changed", "42")
+	listener.notifications <- nil
+
+	for _, expected := range []string{
+		"messageAdded.general=map[channel:general text:hello]",
+		"user_changed=map[id:42 name:Alice]",
+	} {
+		select {
+		case msg := <-received:
+			if msg != expected {
+				t.Errorf("Expected %s, got %s", expected, msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Notification is not published:", expected)
+		}
+	}
+
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Error("Reconnect is not reported")
+	}
+}
+
+func TestNewEventSource_FailsForInvalidChannels(t *testing.T) {
+	_, err := pgnotify.NewEventSource(pgnotify.Config{
+		Listener: newTestListener(),
+		Channels: []string{""},
+		PubSub:   graphqlws.NewInMemoryPubSub(),
+	})
+	if err == nil {
+		t.Error("Invalid channel is listened on")
+	}
+}
+
+// testExecer records the statements it executes.
+type testExecer struct {
+	queries []string
+}
+
+func (e *testExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	e.queries = append(e.queries, fmt.Sprint(query, args))
+	return nil, nil
+}
+
+func TestNotify_RejectsLargePayloads(t *testing.T) {
+	db := &testExecer{}
+
+	if err := pgnotify.Notify(context.Background(), db, "message_added", map[string]string{"text": "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("x", pgnotify.MaxPayloadSize)
+	if err := pgnotify.Notify(context.Background(), db, "message_added", large); err != pgnotify.ErrPayloadTooLarge {
+		t.Error("Large payload is not rejected:", err)
+	}
+
+	if len(db.queries) != 1 || db.queries[0] != `SELECT pg_notify($1, $2)[message_added {"text":"hello"}]` {
+		t.Error("Unexpected statements:", db.queries)
+	}
+}
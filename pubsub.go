@@ -0,0 +1,597 @@
+package graphqlws
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrPubSubSchemaMissing is returned when subscriptions are added to
+	// a bridge that has no schema to execute them against.
+	ErrPubSubSchemaMissing = errors.New("Pub/sub bridge has no schema")
+
+	// ErrSubscriptionRootFields is returned for subscription operations
+	// of a bridge that do not select exactly one root field.
+	ErrSubscriptionRootFields = errors.New("Subscriptions must select exactly one root field")
+)
+
+// PubSubHandler is called with the payloads published to a topic.
+type PubSubHandler func(topic string, payload interface{})
+
+// PubSub is a topic-based publish/subscribe broker, used to trigger
+// the execution of subscriptions when events happen.
+type PubSub interface {
+	// Publish publishes a payload to all handlers subscribed to a topic.
+	Publish(topic string, payload interface{}) error
+
+	// Subscribe subscribes a handler to a topic; calling unsubscribe
+	// stops the handler from being called.
+	Subscribe(topic string, handler PubSubHandler) (unsubscribe func(), err error)
+}
+
+/**
+ * The default, in-memory implementation of the PubSub interface.
+ */
+
+type inMemoryPubSub struct {
+	mutex    *sync.RWMutex
+	handlers map[string]map[uint64]PubSubHandler
+	nextID   uint64
+}
+
+// NewInMemoryPubSub creates a PubSub that delivers payloads within the
+// process. Handlers are called synchronously by Publish, in the order
+// in which they subscribed.
+func NewInMemoryPubSub() PubSub {
+	return &inMemoryPubSub{
+		mutex:    &sync.RWMutex{},
+		handlers: make(map[string]map[uint64]PubSubHandler),
+	}
+}
+
+func (ps *inMemoryPubSub) Publish(topic string, payload interface{}) error {
+	ps.mutex.RLock()
+	ids := make([]uint64, 0, len(ps.handlers[topic]))
+	for id := range ps.handlers[topic] {
+		ids = append(ids, id)
+	}
+	handlers := make([]PubSubHandler, 0, len(ids))
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		handlers = append(handlers, ps.handlers[topic][id])
+	}
+	ps.mutex.RUnlock()
+
+	// Call handlers without holding the lock, so that they may
+	// subscribe, unsubscribe and publish themselves
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+	return nil
+}
+
+func (ps *inMemoryPubSub) Subscribe(topic string, handler PubSubHandler) (func(), error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	ps.nextID++
+	id := ps.nextID
+	if ps.handlers[topic] == nil {
+		ps.handlers[topic] = make(map[uint64]PubSubHandler)
+	}
+	ps.handlers[topic][id] = handler
+
+	return func() {
+		ps.mutex.Lock()
+		defer ps.mutex.Unlock()
+		delete(ps.handlers[topic], id)
+		if len(ps.handlers[topic]) == 0 {
+			delete(ps.handlers, topic)
+		}
+	}, nil
+}
+
+/**
+ * Bridging topics to subscriptions.
+ */
+
+// TopicFunc derives the topic of a subscription from its root field
+// and the values of the field's arguments.
+type TopicFunc func(field string, args map[string]interface{}) string
+
+// FieldTopic is the default TopicFunc; subscriptions listen to a topic
+// named after their root field, regardless of its arguments.
+func FieldTopic(field string, args map[string]interface{}) string {
+	return field
+}
+
+// PubSubBridgeConfig defines the configuration parameters of a bridge
+// between a PubSub and a subscription manager.
+type PubSubBridgeConfig struct {
+	// SubscriptionManager is the manager subscriptions are registered
+	// with; defaults to a new subscription manager for the schema.
+	SubscriptionManager SubscriptionManager
+
+	// Schema is the schema subscriptions are executed against; defaults
+	// to the schema of the subscription manager.
+	Schema *graphql.Schema
+
+	// PubSub is the broker topics are subscribed to; defaults to an
+	// in-memory PubSub.
+	PubSub PubSub
+
+	// Topic derives the topics of subscriptions; defaults to FieldTopic.
+	Topic TopicFunc
+
+	// History records the events published to topics, so that clients
+	// can resume subscriptions with the cursor of the last result they
+	// received; resuming is not supported by default. Topics stay
+	// subscribed to for the retention window of the history after their
+	// last subscription ends, so that events keep being recorded.
+	History EventHistory
+
+	// Logger is used for logging; defaults to a "pubsub" logger.
+	Logger *log.Entry
+}
+
+// PubSubBridge is a subscription manager that subscribes to the topics
+// of the subscriptions it manages and executes them whenever a payload
+// is published to one of their topics.
+//
+// The payload becomes the value of the subscription's root field, so
+// the field resolves to the payload unless it has a resolver of its
+// own; such resolvers find the payload in their source, keyed by the
+// field name.
+type PubSubBridge interface {
+	SubscriptionManager
+
+	// PubSub returns the broker the bridge subscribes to.
+	PubSub() PubSub
+
+	// PublishToUser executes the subscriptions to a topic of the
+	// connections of a user, identified by user key, with a payload.
+	// Unlike payloads published to the broker, it only reaches the
+	// subscriptions of the local instance, and is not recorded in the
+	// event history.
+	PublishToUser(key string, topic string, payload interface{})
+
+	// Close unsubscribes from all topics.
+	Close()
+}
+
+type pubsubTopic struct {
+	unsubscribe   func()
+	subscriptions map[*Subscription]bool
+
+	// Timer unsubscribing from a topic without subscriptions
+	expiry *time.Timer
+}
+
+type pubsubBridge struct {
+	SubscriptionManager
+
+	schema  *graphql.Schema
+	pubsub  PubSub
+	topic   TopicFunc
+	history EventHistory
+	logger  *log.Entry
+
+	mutex              *sync.Mutex
+	topics             map[string]*pubsubTopic
+	subscriptionTopics map[*Subscription][]string
+
+	// Attached subscriptions by connection and subscription ID
+	connections map[Connection]map[string]*Subscription
+
+	// Live events held back from subscriptions replaying their history
+	replaying map[*Subscription][]Event
+}
+
+// NewPubSubBridge creates a subscription manager that executes its
+// subscriptions when payloads are published to their topics. It is
+// passed to the handler in place of a plain subscription manager.
+func NewPubSubBridge(config PubSubBridgeConfig) PubSubBridge {
+	bridge := &pubsubBridge{
+		SubscriptionManager: config.SubscriptionManager,
+		schema:              config.Schema,
+		pubsub:              config.PubSub,
+		topic:               config.Topic,
+		history:             config.History,
+		logger:              config.Logger,
+		mutex:               &sync.Mutex{},
+		topics:              make(map[string]*pubsubTopic),
+		subscriptionTopics:  make(map[*Subscription][]string),
+		connections:         make(map[Connection]map[string]*Subscription),
+		replaying:           make(map[*Subscription][]Event),
+	}
+	if bridge.SubscriptionManager == nil {
+		bridge.SubscriptionManager = NewSubscriptionManager(config.Schema)
+	}
+	if bridge.schema == nil {
+		bridge.schema = managerSchema(bridge.SubscriptionManager)
+	}
+	if bridge.pubsub == nil {
+		bridge.pubsub = NewInMemoryPubSub()
+	}
+	if bridge.topic == nil {
+		bridge.topic = FieldTopic
+	}
+	if bridge.logger == nil {
+		bridge.logger = NewLogger("pubsub")
+	}
+	return bridge
+}
+
+func (b *pubsubBridge) PubSub() PubSub {
+	return b.pubsub
+}
+
+func (b *pubsubBridge) UserSubscriptions(key string) Subscriptions {
+	return SubscriptionsForUser(b.SubscriptionManager, key)
+}
+
+func (b *pubsubBridge) ConnectionSubscriptions(conn Connection) ConnectionSubscriptions {
+	return connectionSubscriptions(b.SubscriptionManager, conn)
+}
+
+func (b *pubsubBridge) Schema() *graphql.Schema {
+	return b.schema
+}
+
+func (b *pubsubBridge) UserKey(user interface{}) string {
+	return managerUserKey(b.SubscriptionManager)(user)
+}
+
+func (b *pubsubBridge) AddConnection(conn Connection) {
+	AddConnection(b.SubscriptionManager, conn)
+}
+
+func (b *pubsubBridge) RemoveConnection(conn Connection) {
+	RemoveConnection(b.SubscriptionManager, conn)
+}
+
+func (b *pubsubBridge) PublishToUser(key string, topic string, payload interface{}) {
+	connections := SubscriptionsForUser(b.SubscriptionManager, key)
+
+	b.mutex.Lock()
+	event := Event{Topic: topic, Payload: payload}
+	subscriptions := []*Subscription{}
+	if t := b.topics[topic]; t != nil {
+		for subscription := range t.subscriptions {
+			if connections[subscription.Connection] != nil && !b.holdBack(subscription, event) {
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	b.executeSubscriptions(subscriptions, event)
+}
+
+func (b *pubsubBridge) AddSubscription(conn Connection, subscription *Subscription) []error {
+	if b.schema == nil {
+		return []error{ErrPubSubSchemaMissing}
+	}
+	if errs := b.SubscriptionManager.AddSubscription(conn, subscription); len(errs) > 0 {
+		return errs
+	}
+
+	// Topics are derived from the root field, so there must be only one
+	if !singleSubscriptionRootField(subscription.Document, subscription.OperationName) {
+		b.SubscriptionManager.RemoveSubscription(conn, subscription)
+		return []error{ErrSubscriptionRootFields}
+	}
+
+	if err := b.attach(conn, subscription); err != nil {
+		b.logger.WithFields(log.Fields{
+			"conn":         conn.ID(),
+			"subscription": subscription.ID,
+			"err":          err,
+		}).Warn("Failed to subscribe to topic")
+		b.SubscriptionManager.RemoveSubscription(conn, subscription)
+		b.detach(conn, subscription)
+		return []error{err}
+	}
+	return nil
+}
+
+func (b *pubsubBridge) RemoveSubscription(conn Connection, subscription *Subscription) {
+	// Look up the attached subscription, as callers typically only pass
+	// its ID
+	b.mutex.Lock()
+	attached := b.connections[conn][subscription.ID]
+	b.mutex.Unlock()
+
+	b.SubscriptionManager.RemoveSubscription(conn, subscription)
+	if attached != nil {
+		b.detach(conn, attached)
+	}
+}
+
+func (b *pubsubBridge) RemoveSubscriptions(conn Connection) {
+	b.mutex.Lock()
+	attached := []*Subscription{}
+	for _, subscription := range b.connections[conn] {
+		attached = append(attached, subscription)
+	}
+	b.mutex.Unlock()
+
+	b.SubscriptionManager.RemoveSubscriptions(conn)
+	for _, subscription := range attached {
+		b.detach(conn, subscription)
+	}
+}
+
+func (b *pubsubBridge) Close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, topic := range b.topics {
+		if topic.expiry != nil {
+			topic.expiry.Stop()
+		}
+		topic.unsubscribe()
+	}
+	b.topics = make(map[string]*pubsubTopic)
+	b.subscriptionTopics = make(map[*Subscription][]string)
+	b.connections = make(map[Connection]map[string]*Subscription)
+	b.replaying = make(map[*Subscription][]Event)
+}
+
+// topicsForSubscription derives the distinct topics of a subscription.
+func (b *pubsubBridge) topicsForSubscription(subscription *Subscription) []string {
+	topics := []string{}
+	seen := make(map[string]bool)
+	for _, field := range subscriptionRootFields(subscription.Document, subscription.OperationName) {
+		topic := b.topic(field.Name.Value, argumentValues(field, subscription.Variables))
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// attach subscribes to the topics of a subscription that no other
+// subscription has subscribed to yet, and replays the events the
+// subscription resumes after.
+func (b *pubsubBridge) attach(conn Connection, subscription *Subscription) error {
+	topics := b.topicsForSubscription(subscription)
+	resume := b.history != nil && subscription.Extensions != nil && subscription.Extensions.Resume != nil
+
+	b.mutex.Lock()
+	if err := b.register(conn, subscription, topics); err != nil {
+		b.mutex.Unlock()
+		return err
+	}
+	if resume {
+		// Hold back live events until the history has been replayed
+		b.replaying[subscription] = []Event{}
+	}
+	b.mutex.Unlock()
+
+	if resume {
+		b.replay(subscription, topics, subscription.Extensions.Resume.Cursor)
+	}
+	return nil
+}
+
+// register subscribes to the topics of a subscription that no other
+// subscription has subscribed to yet; the mutex must be held.
+func (b *pubsubBridge) register(conn Connection, subscription *Subscription, topics []string) error {
+	if b.connections[conn] == nil {
+		b.connections[conn] = make(map[string]*Subscription)
+	}
+	b.connections[conn][subscription.ID] = subscription
+
+	for _, name := range topics {
+		topic := b.topics[name]
+		if topic == nil {
+			unsubscribe, err := b.pubsub.Subscribe(name, b.execute)
+			if err != nil {
+				return err
+			}
+			topic = &pubsubTopic{
+				unsubscribe:   unsubscribe,
+				subscriptions: make(map[*Subscription]bool),
+			}
+			b.topics[name] = topic
+
+			b.logger.WithField("topic", name).Debug("Subscribed to topic")
+		}
+		if topic.expiry != nil {
+			topic.expiry.Stop()
+			topic.expiry = nil
+		}
+		topic.subscriptions[subscription] = true
+		b.subscriptionTopics[subscription] = append(b.subscriptionTopics[subscription], name)
+	}
+	return nil
+}
+
+// detach unsubscribes from the topics of a subscription that no other
+// subscription listens to anymore.
+func (b *pubsubBridge) detach(conn Connection, subscription *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.connections[conn][subscription.ID] == subscription {
+		delete(b.connections[conn], subscription.ID)
+		if len(b.connections[conn]) == 0 {
+			delete(b.connections, conn)
+		}
+	}
+	delete(b.replaying, subscription)
+
+	for _, name := range b.subscriptionTopics[subscription] {
+		topic := b.topics[name]
+		if topic == nil {
+			continue
+		}
+		delete(topic.subscriptions, subscription)
+		if len(topic.subscriptions) > 0 {
+			continue
+		}
+		if b.history != nil {
+			// Keep recording events for subscribers that may resume
+			name, topic := name, topic
+			topic.expiry = time.AfterFunc(b.history.Retention(), func() {
+				b.mutex.Lock()
+				defer b.mutex.Unlock()
+				if b.topics[name] == topic && len(topic.subscriptions) == 0 {
+					b.unsubscribe(name, topic)
+				}
+			})
+		} else {
+			b.unsubscribe(name, topic)
+		}
+	}
+	delete(b.subscriptionTopics, subscription)
+}
+
+// unsubscribe unsubscribes from a topic; the mutex must be held.
+func (b *pubsubBridge) unsubscribe(name string, topic *pubsubTopic) {
+	topic.unsubscribe()
+	delete(b.topics, name)
+
+	b.logger.WithField("topic", name).Debug("Unsubscribed from topic")
+}
+
+// replay sends a subscription the recorded events of its topics that
+// follow a cursor, preceded by ErrHistoryTruncated if some of them are
+// no longer retained or fail to load. Live events held back in the meantime are sent
+// after them, skipping those that were replayed.
+func (b *pubsubBridge) replay(subscription *Subscription, topics []string, cursor uint64) {
+	events := []Event{}
+	truncated := false
+	for _, topic := range topics {
+		recorded, complete, err := b.history.Since(topic, cursor)
+		if err != nil {
+			b.logger.WithFields(log.Fields{
+				"topic": topic,
+				"err":   err,
+			}).Warn("Failed to load event history")
+			events, truncated = nil, true
+			break
+		}
+		events = append(events, recorded...)
+		truncated = truncated || !complete
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+
+	if truncated {
+		subscription.SendData(&DataMessagePayload{
+			Errors:     []error{gqlerrors.FormatError(ErrHistoryTruncated)},
+			Extensions: &DataMessageExtensions{Truncated: true},
+		})
+	}
+	for _, event := range events {
+		b.executeSubscriptions([]*Subscription{subscription}, event)
+		cursor = event.ID
+	}
+
+	// Send the held back events until no more arrive, so that later live
+	// events follow them
+	for {
+		b.mutex.Lock()
+		held, ok := b.replaying[subscription]
+		if !ok || len(held) == 0 {
+			delete(b.replaying, subscription)
+			b.mutex.Unlock()
+			return
+		}
+		b.replaying[subscription] = []Event{}
+		b.mutex.Unlock()
+
+		for _, event := range held {
+			if event.ID == 0 || event.ID > cursor {
+				b.executeSubscriptions([]*Subscription{subscription}, event)
+			}
+		}
+	}
+}
+
+// holdBack holds back a live event from a subscription that is still
+// replaying its history, reporting whether it did; the mutex must be
+// held.
+func (b *pubsubBridge) holdBack(subscription *Subscription, event Event) bool {
+	held, ok := b.replaying[subscription]
+	if ok {
+		b.replaying[subscription] = append(held, event)
+	}
+	return ok
+}
+
+// execute executes the subscriptions of a topic with a published
+// payload and sends the results to their subscribers.
+func (b *pubsubBridge) execute(topic string, payload interface{}) {
+	b.mutex.Lock()
+	event := Event{Topic: topic, Payload: payload}
+	if b.history != nil {
+		recorded, err := b.history.Append(topic, payload)
+		if err != nil {
+			b.logger.WithFields(log.Fields{
+				"topic": topic,
+				"err":   err,
+			}).Warn("Failed to record event")
+		} else {
+			event = recorded
+		}
+	}
+	subscriptions := []*Subscription{}
+	if t := b.topics[topic]; t != nil {
+		for subscription := range t.subscriptions {
+			if !b.holdBack(subscription, event) {
+				subscriptions = append(subscriptions, subscription)
+			}
+		}
+	}
+	b.mutex.Unlock()
+
+	b.executeSubscriptions(subscriptions, event)
+}
+
+// executeSubscriptions executes subscriptions with the payload of an
+// event and sends the results to their subscribers, ordered by
+// connection and subscription ID. Results of recorded events carry
+// their ID as cursor.
+func (b *pubsubBridge) executeSubscriptions(subscriptions []*Subscription, event Event) {
+	sort.Slice(subscriptions, func(i, j int) bool {
+		if x, y := subscriptions[i].Connection.ID(), subscriptions[j].Connection.ID(); x != y {
+			return x < y
+		}
+		return subscriptions[i].ID < subscriptions[j].ID
+	})
+
+	for _, subscription := range subscriptions {
+		root := make(map[string]interface{}, len(subscription.Fields))
+		for _, field := range subscription.Fields {
+			root[field] = event.Payload
+		}
+
+		result := graphql.Execute(graphql.ExecuteParams{
+			Schema:        *b.schema,
+			Root:          root,
+			AST:           subscription.Document,
+			OperationName: subscription.OperationName,
+			Args:          subscription.Variables,
+			Context:       ConnectionContext(subscription.Connection),
+		})
+
+		data := &DataMessagePayload{
+			Data:   result.Data,
+			Errors: ErrorsFromGraphQLErrors(result.Errors),
+		}
+		if event.ID > 0 {
+			data.Extensions = &DataMessageExtensions{Cursor: event.ID}
+		}
+		subscription.SendData(data)
+	}
+}
@@ -0,0 +1,211 @@
+package graphqlws_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/graphql-go/graphql"
+)
+
+// buildMessageSchema builds a schema with a messageAdded subscription
+// for messages in a channel.
+func buildMessageSchema(t *testing.T) *graphql.Schema {
+	message := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Message",
+		Fields: graphql.Fields{
+			"text":    &graphql.Field{Type: graphql.String},
+			"channel": &graphql.Field{Type: graphql.String},
+		},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{"messageAdded": &graphql.Field{
+				Type: message,
+				Args: graphql.FieldConfigArgument{
+					"channel": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+			}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+// channelTopic derives topics like "messageAdded.general".
+func channelTopic(field string, args map[string]interface{}) string {
+	return fmt.Sprintf("%s.%v", field, args["channel"])
+}
+
+// countingPubSub counts the active topic subscriptions of a PubSub.
+type countingPubSub struct {
+	graphqlws.PubSub
+	mutex  sync.Mutex
+	active map[string]int
+}
+
+func (ps *countingPubSub) Subscribe(topic string, handler graphqlws.PubSubHandler) (func(), error) {
+	unsubscribe, err := ps.PubSub.Subscribe(topic, handler)
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.active[topic]++
+	return func() {
+		unsubscribe()
+		ps.mutex.Lock()
+		defer ps.mutex.Unlock()
+		ps.active[topic]--
+	}, err
+}
+
+func (ps *countingPubSub) count(topic string) int {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.active[topic]
+}
+
+func TestInMemoryPubSub(t *testing.T) {
+	pubsub := graphqlws.NewInMemoryPubSub()
+
+	received := []string{}
+	unsubscribe, _ := pubsub.Subscribe("a", func(topic string, payload interface{}) {
+		received = append(received, fmt.Sprint(topic, "=", payload))
+	})
+	pubsub.Subscribe("b", func(topic string, payload interface{}) {
+		received = append(received, fmt.Sprint(topic, "=", payload))
+	})
+
+	pubsub.Publish("a", 1)
+	pubsub.Publish("b", 2)
+	pubsub.Publish("c", 3)
+	unsubscribe()
+	pubsub.Publish("a", 4)
+
+	if fmt.Sprint(received) != "[a=1 b=2]" {
+		t.Error("Unexpected payloads received:", received)
+	}
+}
+
+func TestPubSubBridge_ExecutesSubscriptionsForTopics(t *testing.T) {
+	schema := buildMessageSchema(t)
+	pubsub := &countingPubSub{PubSub: graphqlws.NewInMemoryPubSub(), active: map[string]int{}}
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema: schema,
+		PubSub: pubsub,
+		Topic:  channelTopic,
+	})
+	defer bridge.Close()
+
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{SubscriptionManager: bridge})
+	defer srv.Close()
+
+	query := `subscription ($channel: String!) { messageAdded(channel: $channel) { text } }`
+	general, random := srv.Dial(t), srv.Dial(t)
+	defer general.Close()
+	defer random.Close()
+	for client, channel := range map[*graphqlwstest.Client]string{general: "general", random: "random"} {
+		client.Init(nil)
+		client.ExpectAck()
+		client.Start("1", query, map[string]interface{}{"channel": channel})
+		client.Start("2", `subscription { messageAdded(channel: "general") { channel } }`, nil)
+		client.Start("probe", "{", nil)
+		client.ExpectError("probe")
+	}
+
+	if n := pubsub.count("messageAdded.general"); n != 1 {
+		t.Error("Topic is not subscribed to once:", n)
+	}
+
+	pubsub.Publish("messageAdded.random", map[string]interface{}{"text": "hi", "channel": "random"})
+	random.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "hi"}}`))
+
+	pubsub.Publish("messageAdded.general", map[string]interface{}{"text": "hello", "channel": "general"})
+	for _, client := range []*graphqlwstest.Client{general, random} {
+		if client == general {
+			client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "hello"}}`))
+		}
+		client.ExpectData("2", graphqlwstest.EqualJSON(`{"messageAdded": {"channel": "general"}}`))
+	}
+
+	// Topics are unsubscribed from once no subscription listens to them
+	random.Stop("1")
+	random.Start("probe", "{", nil)
+	random.ExpectError("probe")
+	if n := pubsub.count("messageAdded.random"); n != 0 {
+		t.Error("Topic is still subscribed to:", n)
+	}
+
+	general.Terminate()
+	random.Terminate()
+	general.ExpectClosed()
+	random.ExpectClosed()
+	deadline := time.Now().Add(5 * time.Second)
+	for pubsub.count("messageAdded.general") != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Topic is still subscribed to after connections closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPubSubBridge_ValidatesSchemaAndRootFields(t *testing.T) {
+	// The schema defaults to that of the subscription manager
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildMessageSchema(t)),
+		Topic:               channelTopic,
+	})
+	defer bridge.Close()
+
+	conn := graphqlwstest.NewMockConnection("1", nil)
+	add := func(id string, query string) []error {
+		return bridge.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         id,
+			Query:      query,
+			Connection: conn,
+			SendData:   conn.SendDataFunc(id),
+		})
+	}
+
+	if errs := add("1", `subscription { messageAdded(channel: "general") { text } }`); len(errs) > 0 {
+		t.Fatal("Subscription is rejected:", errs)
+	}
+	bridge.PubSub().Publish("messageAdded.general", map[string]interface{}{"text": "hello"})
+	if !conn.WaitForData(1, time.Second) {
+		t.Fatal("Subscription is not executed with the schema of the manager")
+	}
+
+	// Topics are derived from a single root field
+	errs := add("2", `subscription {
+		a: messageAdded(channel: "general") { text }
+		b: messageAdded(channel: "random") { text }
+	}`)
+	if len(errs) != 1 || errs[0] != graphqlws.ErrSubscriptionRootFields {
+		t.Error("Subscription with several root fields is not rejected:", errs)
+	}
+	if subscriptions := bridge.Subscriptions()[conn]; len(subscriptions) != 1 {
+		t.Error("Rejected subscription is registered:", subscriptions)
+	}
+
+	// Bridges without a schema reject subscriptions instead of failing
+	// on the first event
+	unusable := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{})
+	defer unusable.Close()
+	errs = unusable.AddSubscription(conn, &graphqlws.Subscription{
+		ID:         "3",
+		Query:      `subscription { messageAdded(channel: "general") { text } }`,
+		Connection: conn,
+		SendData:   conn.SendDataFunc("3"),
+	})
+	if len(errs) != 1 || errs[0] != graphqlws.ErrPubSubSchemaMissing {
+		t.Error("Bridge without schema accepts subscriptions:", errs)
+	}
+}
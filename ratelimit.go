@@ -0,0 +1,162 @@
+package graphqlws
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default window in which violations of a rate limit are counted
+const defaultViolationWindow = time.Minute
+
+// tokenBucket is a simple token bucket rate limiter: it holds up to
+// burst tokens and is refilled at rate tokens per second.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket, if there is one.
+func (b *tokenBucket) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// MessageRateLimit defines how many messages a client may send per
+// connection before being throttled. Throttled messages are dropped,
+// and the client is sent an error once per violation window; clients
+// that keep exceeding the limit are disconnected with a policy
+// violation close code.
+//
+// The same MessageRateLimit is shared by all connections of a handler
+// and collects statistics about throttled clients.
+type MessageRateLimit struct {
+	// MessagesPerSecond is the rate at which a connection may send
+	// messages.
+	MessagesPerSecond float64
+
+	// Burst is the number of messages a connection may send at once
+	// before being throttled; defaults to 1.
+	Burst int
+
+	// MaxViolations is the number of throttled messages tolerated per
+	// connection and violation window before it is closed; zero means
+	// connections are never closed for exceeding the limit.
+	MaxViolations int
+
+	// ViolationWindow is the period in which throttled messages are
+	// counted; defaults to 1 minute.
+	ViolationWindow time.Duration
+
+	throttledMessages    uint64
+	throttledConnections uint64
+	disconnections       uint64
+}
+
+// RateLimitStats provides statistics about throttled clients.
+type RateLimitStats struct {
+	// ThrottledMessages is the number of messages dropped because of
+	// the rate limit.
+	ThrottledMessages uint64
+
+	// ThrottledConnections is the number of connections that have been
+	// throttled at least once.
+	ThrottledConnections uint64
+
+	// Disconnections is the number of connections closed because they
+	// kept exceeding the rate limit.
+	Disconnections uint64
+}
+
+// Stats returns statistics about throttled clients.
+func (limit *MessageRateLimit) Stats() RateLimitStats {
+	return RateLimitStats{
+		ThrottledMessages:    atomic.LoadUint64(&limit.throttledMessages),
+		ThrottledConnections: atomic.LoadUint64(&limit.throttledConnections),
+		Disconnections:       atomic.LoadUint64(&limit.disconnections),
+	}
+}
+
+// messageRateLimiter applies a MessageRateLimit to a single connection.
+type messageRateLimiter struct {
+	limit     *MessageRateLimit
+	bucket    *tokenBucket
+	window    time.Duration
+	throttled bool
+
+	// Violations in the current window
+	violations  int
+	windowStart time.Time
+}
+
+func newMessageRateLimiter(limit *MessageRateLimit) *messageRateLimiter {
+	if limit == nil || limit.MessagesPerSecond <= 0 {
+		return nil
+	}
+	window := limit.ViolationWindow
+	if window <= 0 {
+		window = defaultViolationWindow
+	}
+	return &messageRateLimiter{
+		limit:  limit,
+		bucket: newTokenBucket(limit.MessagesPerSecond, limit.Burst),
+		window: window,
+	}
+}
+
+// allow returns whether the next message may be processed. If not, it
+// returns whether the client should be told, which happens once per
+// violation window, and whether the connection should be closed.
+func (l *messageRateLimiter) allow() (allowed bool, notify bool, disconnect bool) {
+	if l == nil || l.bucket.allow() {
+		return true, false, false
+	}
+
+	atomic.AddUint64(&l.limit.throttledMessages, 1)
+	if !l.throttled {
+		l.throttled = true
+		atomic.AddUint64(&l.limit.throttledConnections, 1)
+	}
+
+	// Only count the violations of the current window, so that clients
+	// bursting now and then are not disconnected eventually
+	if now := time.Now(); now.Sub(l.windowStart) > l.window {
+		l.windowStart = now
+		l.violations = 0
+	}
+	l.violations++
+
+	if l.limit.MaxViolations > 0 && l.violations > l.limit.MaxViolations {
+		atomic.AddUint64(&l.limit.disconnections, 1)
+		return false, false, true
+	}
+	return false, l.violations == 1, false
+}
@@ -0,0 +1,106 @@
+package graphqlws_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/gorilla/websocket"
+)
+
+func TestRateLimit_FloodingClientsAreDisconnected(t *testing.T) {
+	schema, err := buildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rateLimit := &graphqlws.MessageRateLimit{
+		MessagesPerSecond: 0.001,
+		Burst:             1,
+		MaxViolations:     2,
+	}
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		RateLimit:           rateLimit,
+	}))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", "graphql-ws")
+	ws, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(srv.URL, "http"),
+		header,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The first message is within the burst and acknowledged
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"connection_init","payload":{}}`))
+	if _, msg, err := ws.ReadMessage(); err != nil || !strings.Contains(string(msg), "connection_ack") {
+		t.Fatalf("Unexpected response to connection_init: %s (%v)", msg, err)
+	}
+
+	// The next messages are throttled; the client is told only once
+	for i := 0; i < 2; i++ {
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"connection_init","payload":{}}`))
+	}
+	if _, msg, err := ws.ReadMessage(); err != nil || !strings.Contains(string(msg), "Rate limit exceeded") {
+		t.Fatalf("Unexpected response to throttled message: %s (%v)", msg, err)
+	}
+
+	// Exceeding the maximum number of violations closes the connection
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"connection_init","payload":{}}`))
+	_, _, err = ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatal("Connection is not closed with a policy violation:", err)
+	}
+
+	stats := rateLimit.Stats()
+	if stats.ThrottledMessages != 3 || stats.ThrottledConnections != 1 || stats.Disconnections != 1 {
+		t.Error("MessageRateLimit reports unexpected stats:", stats)
+	}
+}
+
+func TestRateLimit_ViolationsAreCountedPerWindow(t *testing.T) {
+	schema, err := buildSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(graphqlws.NewHandler(graphqlws.HandlerConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+		RateLimit: &graphqlws.MessageRateLimit{
+			MessagesPerSecond: 0.001,
+			MaxViolations:     1,
+			ViolationWindow:   50 * time.Millisecond,
+		},
+	}))
+	defer srv.Close()
+
+	header := http.Header{}
+	header.Set("Sec-WebSocket-Protocol", "graphql-ws")
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"connection_init","payload":{}}`))
+	ws.ReadMessage()
+
+	// Occasional violations do not add up to a disconnect
+	for i := 0; i < 3; i++ {
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"type":"connection_init","payload":{}}`))
+		if _, msg, err := ws.ReadMessage(); err != nil || !strings.Contains(string(msg), "Rate limit exceeded") {
+			t.Fatalf("Unexpected response to throttled message: %s (%v)", msg, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,283 @@
+// Package redispubsub implements graphqlws.PubSub on top of Redis
+// pub/sub, so that events published by any server instance reach the
+// subscribers connected to all instances:
+//
+//	pubsub := redispubsub.NewPubSub(redispubsub.Config{
+//		Client: redis.NewClient(&redis.Options{Addr: "localhost:6379"}),
+//		Prefix: "graphql:",
+//	})
+//	defer pubsub.Close()
+//
+//	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+//		Schema: &schema,
+//		PubSub: pubsub,
+//	})
+//
+// Payloads are sent as JSON, so handlers receive them as decoded JSON
+// values (maps, slices, strings, float64s and so on). Messages that are
+// not valid JSON, e.g. published by other tools, are passed on as
+// strings.
+package redispubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default delay before receiving again after the connection failed
+const defaultReconnectDelay = time.Second
+
+// Config defines the configuration parameters of a Redis PubSub.
+type Config struct {
+	// Client is the Redis client used for publishing and subscribing.
+	Client redis.UniversalClient
+
+	// Prefix is prepended to topics to form Redis channel names, e.g.
+	// to share a Redis server between applications.
+	Prefix string
+
+	// ReconnectDelay is how long to wait before reconnecting after the
+	// connection to Redis failed; defaults to one second. Channels and
+	// patterns are resubscribed to once the connection is restored;
+	// messages published in the meantime are lost.
+	ReconnectDelay time.Duration
+
+	// Logger is used for logging; defaults to a "redis" logger.
+	Logger *log.Entry
+}
+
+// PubSub is a graphqlws.PubSub backed by Redis.
+type PubSub interface {
+	graphqlws.PubSub
+
+	// PSubscribe subscribes a handler to all topics matching a Redis
+	// glob-style pattern, e.g. "messageAdded.*"; calling unsubscribe
+	// stops the handler from being called.
+	PSubscribe(pattern string, handler graphqlws.PubSubHandler) (unsubscribe func(), err error)
+
+	// Close closes the subscription connection and stops calling
+	// handlers. The client is not closed.
+	Close() error
+}
+
+/**
+ * The default implementation of the PubSub interface.
+ */
+
+type pubsub struct {
+	client         redis.UniversalClient
+	prefix         string
+	reconnectDelay time.Duration
+	logger         *log.Entry
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	redis  *redis.PubSub
+
+	mutex    *sync.Mutex
+	channels map[string]*handlerSet
+	patterns map[string]*handlerSet
+	nextID   uint64
+}
+
+// handlerSet holds the handlers of a channel or pattern.
+type handlerSet struct {
+	handlers map[uint64]graphqlws.PubSubHandler
+
+	// Whether Redis is subscribed to the channel or pattern; changes are
+	// serialized by the writer mutex, so that round trips to Redis happen
+	// outside the mutex of the PubSub
+	subscribed bool
+	writer     sync.Mutex
+}
+
+// NewPubSub creates a PubSub that publishes to and subscribes to Redis
+// channels. It receives messages on a single connection until closed.
+func NewPubSub(config Config) PubSub {
+	ps := &pubsub{
+		client:         config.Client,
+		prefix:         config.Prefix,
+		reconnectDelay: config.ReconnectDelay,
+		logger:         config.Logger,
+		mutex:          &sync.Mutex{},
+		channels:       make(map[string]*handlerSet),
+		patterns:       make(map[string]*handlerSet),
+	}
+	if ps.reconnectDelay <= 0 {
+		ps.reconnectDelay = defaultReconnectDelay
+	}
+	if ps.logger == nil {
+		ps.logger = graphqlws.NewLogger("redis")
+	}
+	ps.ctx, ps.cancel = context.WithCancel(context.Background())
+	ps.redis = ps.client.Subscribe(ps.ctx)
+
+	go ps.receiveLoop()
+
+	return ps
+}
+
+func (ps *pubsub) Publish(topic string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return ps.client.Publish(ps.ctx, ps.prefix+topic, data).Err()
+}
+
+func (ps *pubsub) Subscribe(topic string, handler graphqlws.PubSubHandler) (func(), error) {
+	return ps.subscribe(ps.channels, ps.prefix+topic, handler, ps.redis.Subscribe, ps.redis.Unsubscribe)
+}
+
+func (ps *pubsub) PSubscribe(pattern string, handler graphqlws.PubSubHandler) (func(), error) {
+	return ps.subscribe(ps.patterns, ps.prefix+pattern, handler, ps.redis.PSubscribe, ps.redis.PUnsubscribe)
+}
+
+// subscribe adds a handler for a channel or pattern, subscribing to it
+// in Redis when it gets its first handler and unsubscribing when it
+// loses its last.
+func (ps *pubsub) subscribe(
+	sets map[string]*handlerSet,
+	name string,
+	handler graphqlws.PubSubHandler,
+	subscribe func(context.Context, ...string) error,
+	unsubscribe func(context.Context, ...string) error,
+) (func(), error) {
+	ps.mutex.Lock()
+	set := sets[name]
+	if set == nil {
+		set = &handlerSet{handlers: make(map[uint64]graphqlws.PubSubHandler)}
+		sets[name] = set
+	}
+	ps.nextID++
+	id := ps.nextID
+	set.handlers[id] = handler
+	ps.mutex.Unlock()
+
+	remove := func() {
+		ps.mutex.Lock()
+		_, ok := set.handlers[id]
+		delete(set.handlers, id)
+		ps.mutex.Unlock()
+		if ok {
+			ps.update(sets, name, set, subscribe, unsubscribe)
+		}
+	}
+
+	if err := ps.update(sets, name, set, subscribe, unsubscribe); err != nil {
+		remove()
+		return nil, err
+	}
+	return remove, nil
+}
+
+// update subscribes to a channel or pattern in Redis if it has handlers,
+// and unsubscribes from it otherwise.
+func (ps *pubsub) update(
+	sets map[string]*handlerSet,
+	name string,
+	set *handlerSet,
+	subscribe func(context.Context, ...string) error,
+	unsubscribe func(context.Context, ...string) error,
+) error {
+	set.writer.Lock()
+	defer set.writer.Unlock()
+
+	ps.mutex.Lock()
+	wanted := len(set.handlers) > 0
+	subscribed := set.subscribed
+	ps.mutex.Unlock()
+
+	switch {
+	case wanted && !subscribed:
+		if err := subscribe(ps.ctx, name); err != nil {
+			return err
+		}
+	case !wanted && subscribed:
+		if err := unsubscribe(ps.ctx, name); err != nil {
+			ps.logger.WithFields(log.Fields{
+				"channel": name,
+				"err":     err,
+			}).Warn("Failed to unsubscribe")
+		}
+	}
+
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	set.subscribed = wanted
+	if len(set.handlers) == 0 && sets[name] == set {
+		delete(sets, name)
+	}
+	return nil
+}
+
+func (ps *pubsub) Close() error {
+	ps.cancel()
+	return ps.redis.Close()
+}
+
+func (ps *pubsub) receiveLoop() {
+	for {
+		msg, err := ps.redis.Receive(ps.ctx)
+		if err != nil {
+			if ps.ctx.Err() != nil || errors.Is(err, redis.ErrClosed) {
+				return
+			}
+
+			// The connection is reestablished, and channels resubscribed
+			// to, by the next attempt to receive
+			ps.logger.WithField("err", err).Warn("Failed to receive message, reconnecting")
+			select {
+			case <-ps.ctx.Done():
+				return
+			case <-time.After(ps.reconnectDelay):
+			}
+			continue
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			ps.logger.WithFields(log.Fields{
+				"kind":    msg.Kind,
+				"channel": msg.Channel,
+			}).Debug("Subscription changed")
+		case *redis.Message:
+			ps.dispatch(msg)
+		}
+	}
+}
+
+// dispatch calls the handlers of the channel or pattern a message was
+// received for.
+func (ps *pubsub) dispatch(msg *redis.Message) {
+	ps.mutex.Lock()
+	set := ps.channels[msg.Channel]
+	if msg.Pattern != "" {
+		set = ps.patterns[msg.Pattern]
+	}
+	handlers := []graphqlws.PubSubHandler{}
+	if set != nil {
+		for _, handler := range set.handlers {
+			handlers = append(handlers, handler)
+		}
+	}
+	ps.mutex.Unlock()
+
+	var payload interface{}
+	if err := json.Unmarshal([]byte(msg.Payload), &payload); err != nil {
+		payload = msg.Payload
+	}
+
+	topic := strings.TrimPrefix(msg.Channel, ps.prefix)
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+}
@@ -0,0 +1,153 @@
+package redispubsub_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+	"github.com/functionalfoundry/graphqlws/redispubsub"
+	"github.com/graphql-go/graphql"
+	"github.com/redis/go-redis/v9"
+)
+
+func newPubSub(t *testing.T, mr *miniredis.Miniredis) redispubsub.PubSub {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	pubsub := redispubsub.NewPubSub(redispubsub.Config{
+		Client:         client,
+		Prefix:         "test:",
+		ReconnectDelay: 10 * time.Millisecond,
+	})
+	t.Cleanup(func() { pubsub.Close() })
+	return pubsub
+}
+
+// waitFor waits until a condition holds.
+func waitFor(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, received chan string) string {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message received")
+		return ""
+	}
+}
+
+func TestPubSub_DeliversAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Subscription",
+			Fields: graphql.Fields{"greeting": &graphql.Field{Type: graphql.String}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A client connects to one instance, while the event is published
+	// on another one
+	publisher := newPubSub(t, mr)
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema: &schema,
+		PubSub: newPubSub(t, mr),
+	})
+	defer bridge.Close()
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{SubscriptionManager: bridge})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Init(nil)
+	client.ExpectAck()
+	client.Start("1", "subscription { greeting }", nil)
+
+	waitFor(t, func() bool {
+		return mr.PubSubNumSub("test:greeting")["test:greeting"] == 1
+	}, "Topic is not subscribed to in Redis")
+
+	publisher.Publish("greeting", "hello")
+	client.ExpectData("1", graphqlwstest.EqualJSON(`{"greeting": "hello"}`))
+
+	client.Stop("1")
+	waitFor(t, func() bool {
+		return mr.PubSubNumSub("test:greeting")["test:greeting"] == 0
+	}, "Topic is still subscribed to in Redis")
+}
+
+func TestPubSub_PatternSubscriptions(t *testing.T) {
+	mr := miniredis.RunT(t)
+	pubsub := newPubSub(t, mr)
+
+	received := make(chan string, 10)
+	unsubscribe, err := pubsub.PSubscribe("messageAdded.*", func(topic string, payload interface{}) {
+		received <- fmt.Sprint(topic, "=", payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return mr.PubSubNumPat() == 1 }, "Pattern is not subscribed to in Redis")
+
+	pubsub.Publish("messageAdded.general", map[string]interface{}{"text": "hello"})
+	pubsub.Publish("userJoined.general", "ignored")
+	mr.Publish("test:messageAdded.random", "not json")
+
+	if msg := receive(t, received); msg != "messageAdded.general=map[text:hello]" {
+		t.Error("Unexpected message:", msg)
+	}
+	if msg := receive(t, received); msg != "messageAdded.random=not json" {
+		t.Error("Unexpected message:", msg)
+	}
+
+	unsubscribe()
+	waitFor(t, func() bool { return mr.PubSubNumPat() == 0 }, "Pattern is still subscribed to in Redis")
+}
+
+func TestPubSub_ResubscribesAfterReconnect(t *testing.T) {
+	mr := miniredis.RunT(t)
+	pubsub := newPubSub(t, mr)
+
+	received := make(chan string, 10)
+	pubsub.Subscribe("greeting", func(topic string, payload interface{}) {
+		received <- fmt.Sprint(payload)
+	})
+	waitFor(t, func() bool {
+		return mr.PubSubNumSub("test:greeting")["test:greeting"] == 1
+	}, "Topic is not subscribed to in Redis")
+
+	mr.Close()
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, func() bool {
+		return mr.PubSubNumSub("test:greeting")["test:greeting"] == 1
+	}, "Topic is not resubscribed to after reconnecting")
+
+	if err := pubsub.Publish("greeting", "hello again"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, received); msg != "hello again" {
+		t.Error("Unexpected message:", msg)
+	}
+}
@@ -0,0 +1,472 @@
+package graphqlws
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/graphql-go/graphql"
+	log "github.com/sirupsen/logrus"
+)
+
+// Default time to live of registry records
+const defaultRegistryTTL = 30 * time.Second
+
+// ConnectionRecord describes a connection and its subscriptions in a
+// subscription registry. Records only hold metadata, so that they can
+// be shared between server instances.
+type ConnectionRecord struct {
+	// Node identifies the server instance holding the connection.
+	Node string `json:"node"`
+
+	// ConnectionID is the ID of the connection.
+	ConnectionID string `json:"connectionId"`
+
+	// User is the key of the connection's user, if it has one.
+	User string `json:"user,omitempty"`
+
+	// Subscriptions are the subscriptions of the connection.
+	Subscriptions []SubscriptionRecord `json:"subscriptions"`
+
+	// UpdatedAt is when the record was last stored.
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// SubscriptionRecord describes a subscription in a subscription
+// registry.
+type SubscriptionRecord struct {
+	ID            string   `json:"id"`
+	OperationName string   `json:"operationName,omitempty"`
+	Query         string   `json:"query"`
+	Fields        []string `json:"fields"`
+}
+
+// RegistryBackend stores connection records where all server instances
+// can query them, e.g. in Redis or a database.
+type RegistryBackend interface {
+	// Put stores the record of a connection, replacing any previous
+	// record of it; the record expires unless stored again within ttl.
+	Put(record ConnectionRecord, ttl time.Duration) error
+
+	// Delete deletes the record of a connection.
+	Delete(node string, connectionID string) error
+
+	// List returns all records that have not expired.
+	List() ([]ConnectionRecord, error)
+}
+
+// RegistryQuery selects connection records; empty criteria match all
+// records.
+type RegistryQuery struct {
+	// Field selects connections subscribed to a root field; only the
+	// matching subscriptions of these connections are returned.
+	Field string
+
+	// User selects the connections of a user, by user key.
+	User string
+
+	// Node selects the connections held by a server instance.
+	Node string
+}
+
+// Matches returns whether a record matches the query, ignoring its
+// subscriptions.
+func (query RegistryQuery) Matches(record ConnectionRecord) bool {
+	return (query.User == "" || query.User == record.User) &&
+		(query.Node == "" || query.Node == record.Node)
+}
+
+// RegistryConfig defines the configuration parameters of a
+// subscription registry.
+type RegistryConfig struct {
+	// SubscriptionManager is the manager whose subscriptions are
+	// mirrored to the registry.
+	SubscriptionManager SubscriptionManager
+
+	// Backend stores the records; defaults to an in-memory backend,
+	// which is only useful for tests and single instances.
+	Backend RegistryBackend
+
+	// Node identifies the server instance; defaults to a random ID.
+	Node string
+
+	// TTL is how long records live without being refreshed; defaults to
+	// 30 seconds. Records are refreshed every third of the TTL, so the
+	// records of instances that die expire.
+	TTL time.Duration
+
+	// UserKey derives the user key of connections; defaults to the user
+	// key of the subscription manager, so that records agree with
+	// SubscriptionsForUser.
+	UserKey UserKeyFunc
+
+	// Logger is used for logging; defaults to a "registry" logger.
+	Logger *log.Entry
+}
+
+// Registry is a subscription manager that mirrors the connections and
+// subscriptions it manages to a registry backend shared with other
+// server instances, and answers who is subscribed to what across all
+// of them.
+type Registry interface {
+	SubscriptionManager
+
+	// Node returns the ID of the local server instance.
+	Node() string
+
+	// Query returns the records of all instances matching a query,
+	// ordered by node and connection ID.
+	Query(query RegistryQuery) ([]ConnectionRecord, error)
+
+	// Close stops refreshing the records of the local instance and
+	// deletes them.
+	Close()
+}
+
+type registry struct {
+	SubscriptionManager
+
+	backend RegistryBackend
+	node    string
+	ttl     time.Duration
+	userKey UserKeyFunc
+	logger  *log.Entry
+
+	mutex   *sync.Mutex
+	entries map[Connection]*registryEntry
+	done    chan struct{}
+	closed  sync.Once
+}
+
+// registryEntry holds the record of a local connection. Backend writes
+// happen outside of the registry's mutex; the writer mutex keeps those
+// of a connection in order.
+type registryEntry struct {
+	record  ConnectionRecord
+	deleted bool
+	writer  sync.Mutex
+}
+
+// NewRegistry creates a subscription registry for a subscription
+// manager. It is passed to the handler in place of the manager, and
+// refreshes the records of its connections until closed.
+func NewRegistry(config RegistryConfig) Registry {
+	r := &registry{
+		SubscriptionManager: config.SubscriptionManager,
+		backend:             config.Backend,
+		node:                config.Node,
+		ttl:                 config.TTL,
+		userKey:             config.UserKey,
+		logger:              config.Logger,
+		mutex:               &sync.Mutex{},
+		entries:             make(map[Connection]*registryEntry),
+		done:                make(chan struct{}),
+	}
+	if r.backend == nil {
+		r.backend = NewInMemoryRegistryBackend()
+	}
+	if r.node == "" {
+		r.node = uuid.New().String()
+	}
+	if r.ttl <= 0 {
+		r.ttl = defaultRegistryTTL
+	}
+	if r.userKey == nil {
+		r.userKey = managerUserKey(r.SubscriptionManager)
+	}
+	if r.logger == nil {
+		r.logger = NewLogger("registry")
+	}
+
+	go r.heartbeatLoop()
+
+	return r
+}
+
+func (r *registry) Node() string {
+	return r.node
+}
+
+func (r *registry) UserSubscriptions(key string) Subscriptions {
+	return SubscriptionsForUser(r.SubscriptionManager, key)
+}
+
+func (r *registry) ConnectionSubscriptions(conn Connection) ConnectionSubscriptions {
+	return connectionSubscriptions(r.SubscriptionManager, conn)
+}
+
+func (r *registry) Schema() *graphql.Schema {
+	return managerSchema(r.SubscriptionManager)
+}
+
+func (r *registry) UserKey(user interface{}) string {
+	return managerUserKey(r.SubscriptionManager)(user)
+}
+
+func (r *registry) AddConnection(conn Connection) {
+	AddConnection(r.SubscriptionManager, conn)
+}
+
+func (r *registry) RemoveConnection(conn Connection) {
+	RemoveConnection(r.SubscriptionManager, conn)
+}
+
+func (r *registry) AddSubscription(conn Connection, subscription *Subscription) []error {
+	if errs := r.SubscriptionManager.AddSubscription(conn, subscription); len(errs) > 0 {
+		return errs
+	}
+
+	r.mutex.Lock()
+	entry := r.entries[conn]
+	if entry == nil {
+		entry = &registryEntry{record: ConnectionRecord{
+			Node:         r.node,
+			ConnectionID: conn.ID(),
+			User:         r.userKey(conn.User()),
+		}}
+		r.entries[conn] = entry
+	}
+	if entry.deleted {
+		// The record is being deleted; store it again afterwards
+		entry.deleted = false
+		entry.record.Subscriptions = nil
+	}
+	entry.record.Subscriptions = append(entry.record.Subscriptions, SubscriptionRecord{
+		ID:            subscription.ID,
+		OperationName: subscription.OperationName,
+		Query:         subscription.Query,
+		Fields:        subscription.Fields,
+	})
+	r.mutex.Unlock()
+
+	r.write(conn, entry)
+	return nil
+}
+
+func (r *registry) RemoveSubscription(conn Connection, subscription *Subscription) {
+	r.SubscriptionManager.RemoveSubscription(conn, subscription)
+
+	r.mutex.Lock()
+	entry := r.entries[conn]
+	if entry == nil || entry.deleted {
+		r.mutex.Unlock()
+		return
+	}
+	subscriptions := []SubscriptionRecord{}
+	for _, s := range entry.record.Subscriptions {
+		if s.ID != subscription.ID {
+			subscriptions = append(subscriptions, s)
+		}
+	}
+	entry.record.Subscriptions = subscriptions
+	entry.deleted = len(subscriptions) == 0
+	r.mutex.Unlock()
+
+	r.write(conn, entry)
+}
+
+func (r *registry) RemoveSubscriptions(conn Connection) {
+	r.SubscriptionManager.RemoveSubscriptions(conn)
+
+	r.mutex.Lock()
+	entry := r.entries[conn]
+	if entry == nil || entry.deleted {
+		r.mutex.Unlock()
+		return
+	}
+	entry.deleted = true
+	r.mutex.Unlock()
+
+	r.write(conn, entry)
+}
+
+func (r *registry) Query(query RegistryQuery) ([]ConnectionRecord, error) {
+	records, err := r.backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	out := []ConnectionRecord{}
+	for _, record := range records {
+		if !query.Matches(record) {
+			continue
+		}
+		if query.Field != "" {
+			subscriptions := []SubscriptionRecord{}
+			for _, subscription := range record.Subscriptions {
+				for _, field := range subscription.Fields {
+					if field == query.Field {
+						subscriptions = append(subscriptions, subscription)
+						break
+					}
+				}
+			}
+			if len(subscriptions) == 0 {
+				continue
+			}
+			record.Subscriptions = subscriptions
+		}
+		out = append(out, record)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Node != out[j].Node {
+			return out[i].Node < out[j].Node
+		}
+		return out[i].ConnectionID < out[j].ConnectionID
+	})
+	return out, nil
+}
+
+func (r *registry) Close() {
+	r.closed.Do(func() {
+		close(r.done)
+
+		r.mutex.Lock()
+		entries := make(map[Connection]*registryEntry, len(r.entries))
+		for conn, entry := range r.entries {
+			entry.deleted = true
+			entries[conn] = entry
+		}
+		r.mutex.Unlock()
+
+		for conn, entry := range entries {
+			r.write(conn, entry)
+		}
+	})
+}
+
+// write stores the current record of a connection in the backend, or
+// deletes it. Records are copied under the mutex, but written outside
+// of it, so that slow backends do not hold up other connections.
+// Failures are only logged, as the registry must not get in the way of
+// serving subscriptions.
+func (r *registry) write(conn Connection, entry *registryEntry) {
+	entry.writer.Lock()
+	defer entry.writer.Unlock()
+
+	r.mutex.Lock()
+	if r.entries[conn] != entry {
+		// The record has been deleted already
+		r.mutex.Unlock()
+		return
+	}
+	deleted := entry.deleted
+	entry.record.UpdatedAt = time.Now()
+	record := r.copyRecord(&entry.record)
+	r.mutex.Unlock()
+
+	if !deleted {
+		if err := r.backend.Put(record, r.ttl); err != nil {
+			r.logger.WithFields(log.Fields{
+				"conn": record.ConnectionID,
+				"err":  err,
+			}).Warn("Failed to store connection record")
+		}
+		return
+	}
+
+	if err := r.backend.Delete(r.node, record.ConnectionID); err != nil {
+		r.logger.WithFields(log.Fields{
+			"conn": record.ConnectionID,
+			"err":  err,
+		}).Warn("Failed to delete connection record")
+	}
+
+	// Forget the record, unless the connection has subscribed again
+	r.mutex.Lock()
+	if entry.deleted && r.entries[conn] == entry {
+		delete(r.entries, conn)
+	}
+	r.mutex.Unlock()
+}
+
+// copyRecord copies a record, so that backends may keep it.
+func (r *registry) copyRecord(record *ConnectionRecord) ConnectionRecord {
+	out := *record
+	out.Subscriptions = append([]SubscriptionRecord{}, record.Subscriptions...)
+	return out
+}
+
+// heartbeatLoop refreshes the records of the local connections before
+// they expire.
+func (r *registry) heartbeatLoop() {
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.mutex.Lock()
+			entries := make(map[Connection]*registryEntry, len(r.entries))
+			for conn, entry := range r.entries {
+				entries[conn] = entry
+			}
+			r.mutex.Unlock()
+
+			for conn, entry := range entries {
+				r.write(conn, entry)
+			}
+		}
+	}
+}
+
+/**
+ * The default, in-memory implementation of the RegistryBackend interface.
+ */
+
+type inMemoryRegistryEntry struct {
+	record    ConnectionRecord
+	expiresAt time.Time
+}
+
+type inMemoryRegistryBackend struct {
+	mutex   *sync.Mutex
+	entries map[string]*inMemoryRegistryEntry
+}
+
+// NewInMemoryRegistryBackend creates a registry backend that keeps
+// records in memory. Registries sharing it behave like instances
+// sharing a store, which makes it useful for tests.
+func NewInMemoryRegistryBackend() RegistryBackend {
+	return &inMemoryRegistryBackend{
+		mutex:   &sync.Mutex{},
+		entries: make(map[string]*inMemoryRegistryEntry),
+	}
+}
+
+func (b *inMemoryRegistryBackend) Put(record ConnectionRecord, ttl time.Duration) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.entries[record.Node+"/"+record.ConnectionID] = &inMemoryRegistryEntry{
+		record:    record,
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (b *inMemoryRegistryBackend) Delete(node string, connectionID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.entries, node+"/"+connectionID)
+	return nil
+}
+
+func (b *inMemoryRegistryBackend) List() ([]ConnectionRecord, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	records := []ConnectionRecord{}
+	for key, entry := range b.entries {
+		if now.After(entry.expiresAt) {
+			delete(b.entries, key)
+			continue
+		}
+		records = append(records, entry.record)
+	}
+	return records, nil
+}
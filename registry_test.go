@@ -0,0 +1,205 @@
+package graphqlws_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+)
+
+func TestRegistry_QueriesSubscriptionsAcrossNodes(t *testing.T) {
+	schema := buildMessageSchema(t)
+	backend := graphqlws.NewInMemoryRegistryBackend()
+
+	clients := map[string]*graphqlwstest.Client{}
+	registries := map[string]graphqlws.Registry{}
+	for _, node := range []string{"a", "b"} {
+		registry := graphqlws.NewRegistry(graphqlws.RegistryConfig{
+			SubscriptionManager: graphqlws.NewSubscriptionManager(schema),
+			Backend:             backend,
+			Node:                node,
+			TTL:                 300 * time.Millisecond,
+		})
+		defer registry.Close()
+		registries[node] = registry
+
+		srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+			SubscriptionManager: registry,
+			Authenticate: func(token string) (interface{}, error) {
+				return token, nil
+			},
+		})
+		defer srv.Close()
+
+		client := srv.Dial(t)
+		defer client.Close()
+		clients[node] = client
+	}
+
+	clients["a"].Init(graphqlws.InitMessagePayload{AuthToken: "alice"})
+	clients["b"].Init(graphqlws.InitMessagePayload{AuthToken: "bob"})
+	for _, client := range clients {
+		client.ExpectAck()
+		client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+		client.Start("probe", "{", nil)
+		client.ExpectError("probe")
+	}
+
+	// Records outlive their TTL as long as they are refreshed
+	time.Sleep(500 * time.Millisecond)
+
+	records, err := registries["a"].Query(graphqlws.RegistryQuery{Field: "messageAdded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].Node != "a" || records[1].Node != "b" {
+		t.Fatal("Subscriptions of all nodes are not registered:", records)
+	}
+	if records[0].User != "alice" || len(records[0].Subscriptions) != 1 || records[0].Subscriptions[0].ID != "1" {
+		t.Error("Unexpected record:", records[0])
+	}
+
+	records, _ = registries["a"].Query(graphqlws.RegistryQuery{User: "bob"})
+	if len(records) != 1 || records[0].Node != "b" {
+		t.Error("Connections are not found by user:", records)
+	}
+	records, _ = registries["a"].Query(graphqlws.RegistryQuery{Field: "greeting"})
+	if len(records) != 0 {
+		t.Error("Connections are found for other fields:", records)
+	}
+
+	clients["b"].Stop("1")
+	clients["b"].Start("probe", "{", nil)
+	clients["b"].ExpectError("probe")
+	records, _ = registries["a"].Query(graphqlws.RegistryQuery{})
+	if len(records) != 1 || records[0].Node != "a" {
+		t.Error("Stopped subscription is still registered:", records)
+	}
+
+	registries["a"].Close()
+	records, _ = registries["b"].Query(graphqlws.RegistryQuery{})
+	if len(records) != 0 {
+		t.Error("Records of closed registry are not deleted:", records)
+	}
+}
+
+// slowRegistryBackend blocks storing the records of a connection until
+// released.
+type slowRegistryBackend struct {
+	graphqlws.RegistryBackend
+	slow    string
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (b *slowRegistryBackend) Put(record graphqlws.ConnectionRecord, ttl time.Duration) error {
+	if record.ConnectionID == b.slow {
+		close(b.blocked)
+		<-b.release
+	}
+	return b.RegistryBackend.Put(record, ttl)
+}
+
+func TestRegistry_SlowBackendsDoNotHoldUpOtherConnections(t *testing.T) {
+	backend := &slowRegistryBackend{
+		RegistryBackend: graphqlws.NewInMemoryRegistryBackend(),
+		slow:            "slow",
+		blocked:         make(chan struct{}),
+		release:         make(chan struct{}),
+	}
+	registry := graphqlws.NewRegistry(graphqlws.RegistryConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManager(buildMessageSchema(t)),
+		Backend:             backend,
+	})
+	defer registry.Close()
+
+	subscribe := func(id string) {
+		conn := graphqlwstest.NewMockConnection(id, nil)
+		errs := registry.AddSubscription(conn, &graphqlws.Subscription{
+			ID:         "1",
+			Query:      `subscription { messageAdded(channel: "general") { text } }`,
+			Connection: conn,
+			SendData:   conn.SendDataFunc("1"),
+		})
+		if len(errs) > 0 {
+			t.Error("Failed to add subscription:", errs)
+		}
+	}
+
+	slow := make(chan struct{})
+	go func() {
+		defer close(slow)
+		subscribe("slow")
+	}()
+	<-backend.blocked
+
+	fast := make(chan struct{})
+	go func() {
+		defer close(fast)
+		subscribe("fast")
+	}()
+	select {
+	case <-fast:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connections are held up by a slow backend")
+	}
+
+	close(backend.release)
+	<-slow
+	if records, _ := registry.Query(graphqlws.RegistryQuery{}); len(records) != 2 {
+		t.Error("Records are not stored:", records)
+	}
+}
+
+func TestInMemoryRegistryBackend_ExpiresRecords(t *testing.T) {
+	backend := graphqlws.NewInMemoryRegistryBackend()
+	backend.Put(graphqlws.ConnectionRecord{Node: "a", ConnectionID: "1"}, 20*time.Millisecond)
+	backend.Put(graphqlws.ConnectionRecord{Node: "a", ConnectionID: "2"}, time.Minute)
+
+	time.Sleep(50 * time.Millisecond)
+
+	records, _ := backend.List()
+	if len(records) != 1 || records[0].ConnectionID != "2" {
+		t.Error("Records do not expire:", records)
+	}
+}
+
+func TestRegistry_RecordsUserKeysOfManager(t *testing.T) {
+	registry := graphqlws.NewRegistry(graphqlws.RegistryConfig{
+		SubscriptionManager: graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+			Schema: buildMessageSchema(t),
+			UserKey: func(user interface{}) string {
+				return user.(testUser).ID
+			},
+		}),
+	})
+	defer registry.Close()
+
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: registry,
+		Authenticate: func(token string) (interface{}, error) {
+			return testUser{ID: token, Name: "User " + token}, nil
+		},
+	})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice"})
+	client.ExpectAck()
+	client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+
+	records, err := registry.Query(graphqlws.RegistryQuery{User: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].User != "alice" {
+		t.Error("Records do not carry the user key of the manager:", records)
+	}
+	if subscriptions := graphqlws.SubscriptionsForUser(registry, "alice"); len(subscriptions) != 1 {
+		t.Error("Connections are not indexed by the same user key:", subscriptions)
+	}
+}
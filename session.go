@@ -0,0 +1,356 @@
+package graphqlws
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Default time sessions of lost connections are kept for
+	defaultSessionGracePeriod = 30 * time.Second
+
+	// Default number of messages buffered for lost connections
+	defaultSessionBufferSize = 100
+)
+
+// SessionConfig enables clients to resume their session after losing
+// the connection. Clients are sent a session token in the connection
+// ack message; by passing it in the init message of a new connection
+// within the grace period, they get back the operations of the lost
+// connection, along with the results sent in the meantime, instead of
+// starting them again.
+type SessionConfig struct {
+	// GracePeriod is how long the operations of a lost connection are
+	// kept; defaults to 30 seconds.
+	GracePeriod time.Duration
+
+	// BufferSize is the number of messages buffered for a lost
+	// connection; sessions exceeding it end early, as results would be
+	// lost. Defaults to 100.
+	BufferSize int
+}
+
+/**
+ * Sessions implement the Connection interface, so that subscriptions
+ * are registered with them rather than with the underlying WebSocket
+ * connection, and survive switching to another connection.
+ */
+
+// sessionMessage is a message buffered for a lost connection.
+type sessionMessage struct {
+	opID string
+	data *DataMessagePayload
+	err  error
+}
+
+type session struct {
+	id    string
+	token string
+	user  interface{}
+	store *sessionStore
+
+	// Operations are executed with the context of the session, so that
+	// they are not cancelled along with a lost connection
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex *sync.Mutex
+
+	// The current connection; it is attached until it is lost, and
+	// live once it has been acknowledged
+	conn     Connection
+	attached bool
+	live     bool
+
+	pending    []sessionMessage
+	overflowed bool
+	expiry     *time.Timer
+}
+
+func (s *session) ID() string {
+	return s.id
+}
+
+func (s *session) User() interface{} {
+	return s.user
+}
+
+// Context returns the context of the session, which carries the values
+// of the context of its first connection and is cancelled when the
+// session ends.
+func (s *session) Context() context.Context {
+	return s.ctx
+}
+
+func (s *session) SendData(opID string, data *DataMessagePayload) {
+	s.send(sessionMessage{opID: opID, data: data})
+}
+
+func (s *session) SendError(err error) {
+	s.send(sessionMessage{err: err})
+}
+
+// send sends a message via the current connection, or buffers it
+// until the connection is live. Sessions of lost connections end once
+// their buffer overflows.
+func (s *session) send(msg sessionMessage) {
+	s.mutex.Lock()
+	if s.live {
+		// Sending blocks while the connection's queue is full, so the
+		// mutex is released first
+		conn := s.conn
+		s.mutex.Unlock()
+		msg.sendTo(conn)
+		return
+	}
+	defer s.mutex.Unlock()
+
+	if s.overflowed {
+		return
+	}
+	s.pending = append(s.pending, msg)
+	if !s.attached && len(s.pending) > s.store.config.BufferSize {
+		s.overflowed = true
+		s.pending = nil
+		if s.expiry != nil {
+			s.expiry.Stop()
+		}
+
+		// Messages may be sent while subscription managers hold locks
+		s.store.logger.WithField("session", s.id).Warn("Session buffer overflowed")
+		go s.store.expire(s)
+	}
+}
+
+// sendTo sends a message via a connection.
+func (msg sessionMessage) sendTo(conn Connection) {
+	if msg.err != nil {
+		conn.SendError(msg.err)
+	} else {
+		conn.SendData(msg.opID, msg.data)
+	}
+}
+
+// detachedContext carries the values of a context, but is never
+// cancelled.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+/**
+ * The session store tracks the sessions of a handler.
+ */
+
+type sessionStore struct {
+	config  SessionConfig
+	manager SubscriptionManager
+	logger  *log.Entry
+
+	mutex    *sync.Mutex
+	sessions map[string]*session
+	conns    map[Connection]*session
+}
+
+func newSessionStore(config SessionConfig, manager SubscriptionManager) *sessionStore {
+	if config.GracePeriod <= 0 {
+		config.GracePeriod = defaultSessionGracePeriod
+	}
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultSessionBufferSize
+	}
+	return &sessionStore{
+		config:   config,
+		manager:  manager,
+		logger:   NewLogger("sessions"),
+		mutex:    &sync.Mutex{},
+		sessions: make(map[string]*session),
+		conns:    make(map[Connection]*session),
+	}
+}
+
+// connection returns the session of a connection, or the connection
+// itself if it has none.
+func (store *sessionStore) connection(conn Connection) Connection {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if s := store.conns[conn]; s != nil {
+		return s
+	}
+	return conn
+}
+
+// init resumes the session a connection asks for, if it still exists
+// and belongs to the same user, and starts a new session otherwise.
+// It returns the payload of the connection ack message.
+func (store *sessionStore) init(conn Connection, data *InitMessagePayload) interface{} {
+	store.mutex.Lock()
+	userKey := managerUserKey(store.manager)
+	if s := store.sessions[data.SessionToken]; s != nil && userKey(s.user) == userKey(conn.User()) && store.resume(s, conn) {
+		store.mutex.Unlock()
+
+		store.logger.WithFields(log.Fields{
+			"session": s.id,
+			"conn":    conn.ID(),
+		}).Debug("Resumed session")
+
+		return &ConnectionAckPayload{
+			SessionToken: s.token,
+			Resumed:      true,
+			Operations:   store.operations(s),
+		}
+	}
+	defer store.mutex.Unlock()
+
+	s := &session{
+		id:       conn.ID(),
+		token:    uuid.New().String(),
+		user:     conn.User(),
+		store:    store,
+		mutex:    &sync.Mutex{},
+		conn:     conn,
+		attached: true,
+	}
+	s.ctx, s.cancel = context.WithCancel(detachedContext{ConnectionContext(conn)})
+	store.sessions[s.token] = s
+	store.conns[conn] = s
+	return &ConnectionAckPayload{SessionToken: s.token}
+}
+
+// resume attaches a connection to a session, taking over from the
+// previous connection even if it has not been noticed to be lost yet;
+// the store's mutex must be held. It returns false for sessions that
+// are ending.
+func (store *sessionStore) resume(s *session, conn Connection) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.overflowed {
+		return false
+	}
+
+	delete(store.conns, s.conn)
+	store.conns[conn] = s
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	s.conn = conn
+	s.attached = true
+	s.live = false
+	return true
+}
+
+// operations returns the IDs of the operations of a session, sorted.
+func (store *sessionStore) operations(s *session) []string {
+	ids := []string{}
+	for id := range connectionSubscriptions(store.manager, s) {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// acknowledged makes the session of a connection live, once the
+// connection is acknowledged, sending it the messages buffered so far.
+// Messages keep being buffered until none are left, so that they are
+// sent in order.
+func (store *sessionStore) acknowledged(conn Connection) {
+	store.mutex.Lock()
+	s := store.conns[conn]
+	store.mutex.Unlock()
+	if s == nil {
+		return
+	}
+
+	for {
+		s.mutex.Lock()
+		if s.conn != conn {
+			s.mutex.Unlock()
+			return
+		}
+		pending := s.pending
+		s.pending = nil
+		if len(pending) == 0 {
+			s.live = true
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+
+		for _, msg := range pending {
+			msg.sendTo(conn)
+		}
+	}
+}
+
+// detach detaches a lost connection from its session. Its session is
+// kept for the grace period, unless the client terminated the
+// connection deliberately.
+func (store *sessionStore) detach(conn Connection) {
+	store.mutex.Lock()
+	s := store.conns[conn]
+	delete(store.conns, conn)
+	store.mutex.Unlock()
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.conn != conn {
+		// Another connection has taken over already
+		s.mutex.Unlock()
+		return
+	}
+	s.attached = false
+	s.live = false
+	terminated := false
+	if c, ok := conn.(interface{ terminatedByClient() bool }); ok {
+		terminated = c.terminatedByClient()
+	}
+	if !terminated {
+		s.expiry = time.AfterFunc(store.config.GracePeriod, func() {
+			store.expire(s)
+		})
+	}
+	s.mutex.Unlock()
+
+	if terminated {
+		store.expire(s)
+	}
+}
+
+// expire ends a session unless a connection has been attached to it
+// in the meantime, removing its subscriptions.
+func (store *sessionStore) expire(s *session) {
+	store.mutex.Lock()
+	s.mutex.Lock()
+	if s.attached || store.sessions[s.token] != s {
+		s.mutex.Unlock()
+		store.mutex.Unlock()
+		return
+	}
+	delete(store.sessions, s.token)
+	s.mutex.Unlock()
+	store.mutex.Unlock()
+
+	store.logger.WithField("session", s.id).Debug("Ended session")
+	store.manager.RemoveSubscriptions(s)
+	RemoveConnection(store.manager, s)
+	s.cancel()
+}
@@ -0,0 +1,187 @@
+package graphqlws_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+)
+
+// expectAck expects the server to acknowledge the connection and
+// returns the session it sends.
+func expectAck(t *testing.T, client *graphqlwstest.Client) graphqlws.ConnectionAckPayload {
+	t.Helper()
+	ack := graphqlws.ConnectionAckPayload{}
+	if err := json.Unmarshal(client.Expect("", "connection_ack").Payload, &ack); err != nil {
+		t.Fatal("Invalid ack payload:", err)
+	}
+	return ack
+}
+
+func TestSessions_ResumeOperationsAfterReconnect(t *testing.T) {
+	schema := buildMessageSchema(t)
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema: schema,
+		Topic:  channelTopic,
+	})
+	defer bridge.Close()
+
+	// Connection contexts tell when the server notices lost connections
+	contexts := make(chan context.Context, 10)
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: bridge,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+		Context: func(ctx context.Context, r *http.Request, user interface{}) context.Context {
+			contexts <- ctx
+			return ctx
+		},
+		Sessions: &graphqlws.SessionConfig{GracePeriod: time.Minute},
+	})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice"})
+	session := expectAck(t, client)
+	if session.SessionToken == "" || session.Resumed {
+		t.Fatal("Unexpected session:", session)
+	}
+	client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+
+	// Results are buffered while the client is away
+	client.Close()
+	select {
+	case <-(<-contexts).Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lost connection is not noticed")
+	}
+	bridge.PubSub().Publish("messageAdded.general", map[string]interface{}{"text": "missed"})
+
+	// Other users cannot take over the session
+	intruder := srv.Dial(t)
+	defer intruder.Close()
+	intruder.Init(graphqlws.InitMessagePayload{AuthToken: "mallory", SessionToken: session.SessionToken})
+	if ack := expectAck(t, intruder); ack.Resumed || ack.SessionToken == session.SessionToken {
+		t.Error("Session of other user is resumed:", ack)
+	}
+
+	client = srv.Dial(t)
+	defer client.Close()
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice", SessionToken: session.SessionToken})
+	ack := expectAck(t, client)
+	if !ack.Resumed || len(ack.Operations) != 1 || ack.Operations[0] != "1" {
+		t.Fatal("Session is not resumed:", ack)
+	}
+	client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "missed"}}`))
+
+	bridge.PubSub().Publish("messageAdded.general", map[string]interface{}{"text": "live"})
+	client.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "live"}}`))
+	intruder.ExpectNoMessage(50 * time.Millisecond)
+
+	if subscriptions := bridge.Subscriptions(); len(subscriptions) != 1 {
+		t.Error("Subscriptions are registered again:", subscriptions)
+	}
+
+	// Sessions end right away when clients terminate them
+	client.Terminate()
+	client.ExpectClosed()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(bridge.Subscriptions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscriptions of terminated session are kept")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessions_EndAfterGracePeriod(t *testing.T) {
+	schema := buildMessageSchema(t)
+	manager := graphqlws.NewSubscriptionManager(schema)
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Sessions:            &graphqlws.SessionConfig{GracePeriod: 50 * time.Millisecond},
+	})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	client.Init(nil)
+	session := expectAck(t, client)
+	client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+	client.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.Subscriptions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscriptions outlive the grace period")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client = srv.Dial(t)
+	defer client.Close()
+	client.Init(graphqlws.InitMessagePayload{SessionToken: session.SessionToken})
+	if ack := expectAck(t, client); ack.Resumed {
+		t.Error("Ended session is resumed:", ack)
+	}
+}
+
+func TestSessions_RejectOperationsBeforeInit(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildMessageSchema(t))
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Sessions:            &graphqlws.SessionConfig{},
+	})
+	defer srv.Close()
+
+	// Operations started before init would not belong to the session
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+	client.ExpectError("1")
+	if subscriptions := manager.Subscriptions(); len(subscriptions) != 0 {
+		t.Error("Operation started before init is registered:", subscriptions)
+	}
+}
+
+func TestSessions_ResumeForSameUserKey(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema: buildMessageSchema(t),
+		UserKey: func(user interface{}) string {
+			return user.(testUser).ID
+		},
+	})
+
+	// Each connection gets a user value of its own
+	logins := 0
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Authenticate: func(token string) (interface{}, error) {
+			logins++
+			return testUser{ID: token, Name: fmt.Sprintf("Login %d", logins)}, nil
+		},
+		Sessions: &graphqlws.SessionConfig{GracePeriod: time.Minute},
+	})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice"})
+	session := expectAck(t, client)
+	client.Close()
+
+	client = srv.Dial(t)
+	defer client.Close()
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice", SessionToken: session.SessionToken})
+	if ack := expectAck(t, client); !ack.Resumed {
+		t.Error("Session is not resumed for the same user key:", ack)
+	}
+}
@@ -0,0 +1,345 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Header (or query parameter) carrying the reservation token of a
+	// stream in single-connection mode
+	sseTokenHeader = "X-GraphQL-Event-Stream-Token"
+	sseTokenParam  = "token"
+
+	// Event types of the GraphQL over SSE protocol
+	sseNext     = "next"
+	sseComplete = "complete"
+
+	// Default interval of keep-alive comments on open streams
+	sseKeepAlive = 12 * time.Second
+
+	// How long reserved streams may remain unopened
+	sseReservationTimeout = 30 * time.Second
+)
+
+// SSEHandlerConfig stores the configuration of a GraphQL over
+// Server-Sent Events handler.
+type SSEHandlerConfig struct {
+	SubscriptionManager SubscriptionManager
+	Authenticate        AuthenticateFunc
+
+	// AuthToken extracts the token passed to Authenticate from a request;
+	// defaults to the bearer token of the Authorization header.
+	AuthToken func(*http.Request) string
+
+	// PersistedQueries enables support for automatic persisted queries.
+	PersistedQueries *PersistedQueryConfig
+
+	// MaxBodySize limits the size of POST request bodies; defaults to
+	// 1 MiB.
+	MaxBodySize int64
+
+	// KeepAlive is the interval at which comments are sent to keep
+	// streams from being closed by proxies; defaults to 12 seconds.
+	KeepAlive time.Duration
+}
+
+// NewSSEHandler creates an HTTP handler that implements the GraphQL over
+// Server-Sent Events protocol (https://github.com/enisdenjo/graphql-sse)
+// for clients that cannot use WebSockets. Subscriptions are added to the
+// SubscriptionManager just like those of WebSocket clients.
+//
+// In distinct-connections mode, each GET or POST request with an
+// operation opens an event stream for that operation. In
+// single-connection mode, clients reserve a stream with a PUT request,
+// open it with a GET request and start and stop operations on it with
+// POST and DELETE requests, all carrying the reservation token.
+func NewSSEHandler(config SSEHandlerConfig) http.Handler {
+	if config.AuthToken == nil {
+		config.AuthToken = bearerToken
+	}
+	if config.KeepAlive <= 0 {
+		config.KeepAlive = sseKeepAlive
+	}
+	if config.MaxBodySize <= 0 {
+		config.MaxBodySize = defaultMaxBodySize
+	}
+	return &sseHandler{
+		config:  config,
+		logger:  NewLogger("sse"),
+		streams: make(map[string]*sseConnection),
+	}
+}
+
+type sseHandler struct {
+	config  SSEHandlerConfig
+	logger  *log.Entry
+	mutex   sync.Mutex
+	streams map[string]*sseConnection
+}
+
+func (h *sseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		h.reserveStream(w, r)
+		return
+	}
+
+	token := r.Header.Get(sseTokenHeader)
+	if token == "" {
+		token = r.URL.Query().Get(sseTokenParam)
+	}
+	if token == "" {
+		h.serveDistinct(w, r)
+		return
+	}
+
+	h.mutex.Lock()
+	conn := h.streams[token]
+	h.mutex.Unlock()
+	if conn == nil {
+		writeErrorsResponse(w, http.StatusNotFound, []error{errors.New("Stream not found")})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !acceptsEventStream(r) {
+			writeErrorsResponse(w, http.StatusNotAcceptable, []error{errors.New("Event stream not accepted")})
+			return
+		}
+		h.serveStream(w, r, token, conn)
+
+	case http.MethodPost:
+		data, opID, err := readOperationRequest(w, r, h.config.MaxBodySize)
+		if err == nil && opID == "" {
+			err = errors.New("Operation ID is missing")
+		}
+		if err != nil {
+			writeErrorsResponse(w, http.StatusBadRequest, []error{err})
+			return
+		}
+		if errs := h.startOperation(conn, opID, data); len(errs) > 0 {
+			writeErrorsResponse(w, http.StatusBadRequest, errs)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	case http.MethodDelete:
+		opID := r.URL.Query().Get("operationId")
+		if opID == "" {
+			writeErrorsResponse(w, http.StatusBadRequest, []error{errors.New("Operation ID is missing")})
+			return
+		}
+		h.config.SubscriptionManager.RemoveSubscription(conn, &Subscription{ID: opID})
+		conn.sendComplete(opID)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		writeErrorsResponse(w, http.StatusMethodNotAllowed, []error{errors.New("Method not allowed")})
+	}
+}
+
+// reserveStream reserves a stream for single-connection mode and
+// responds with its token.
+func (h *sseHandler) reserveStream(w http.ResponseWriter, r *http.Request) {
+	user, err := h.authenticate(r)
+	if err != nil {
+		writeErrorsResponse(w, http.StatusUnauthorized, []error{err})
+		return
+	}
+
+	token := uuid.New().String()
+	conn := newSSEConnection(user, true)
+
+	h.mutex.Lock()
+	h.streams[token] = conn
+	h.mutex.Unlock()
+	AddConnection(h.config.SubscriptionManager, conn)
+
+	// Forget streams that are never opened
+	time.AfterFunc(sseReservationTimeout, func() {
+		if !conn.isClaimed() {
+			h.closeStream(token, conn)
+		}
+	})
+
+	h.logger.WithFields(log.Fields{
+		"conn": conn.ID(),
+		"user": user,
+	}).Debug("Reserved stream")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	w.Write([]byte(token))
+}
+
+// serveStream opens the event stream of a reserved stream.
+func (h *sseHandler) serveStream(w http.ResponseWriter, r *http.Request, token string, conn *sseConnection) {
+	if !conn.claim() {
+		writeErrorsResponse(w, http.StatusConflict, []error{errors.New("Stream is already open")})
+		return
+	}
+	defer h.closeStream(token, conn)
+	h.stream(w, r, conn)
+}
+
+func (h *sseHandler) closeStream(token string, conn *sseConnection) {
+	h.mutex.Lock()
+	if h.streams[token] == conn {
+		delete(h.streams, token)
+	}
+	h.mutex.Unlock()
+
+	conn.close()
+	h.config.SubscriptionManager.RemoveSubscriptions(conn)
+	RemoveConnection(h.config.SubscriptionManager, conn)
+}
+
+// serveDistinct serves an operation on its own event stream.
+func (h *sseHandler) serveDistinct(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeErrorsResponse(w, http.StatusMethodNotAllowed, []error{errors.New("Method not allowed")})
+		return
+	}
+	if !acceptsEventStream(r) {
+		writeErrorsResponse(w, http.StatusNotAcceptable, []error{errors.New("Event stream not accepted")})
+		return
+	}
+
+	user, err := h.authenticate(r)
+	if err != nil {
+		writeErrorsResponse(w, http.StatusUnauthorized, []error{err})
+		return
+	}
+
+	data, _, err := readOperationRequest(w, r, h.config.MaxBodySize)
+	if err != nil {
+		writeErrorsResponse(w, http.StatusBadRequest, []error{err})
+		return
+	}
+
+	// There is only one operation per connection, so the connection ID
+	// doubles as the operation ID
+	// The connection is indexed first, so that results published right
+	// away reach it
+	conn := newSSEConnection(user, false)
+	AddConnection(h.config.SubscriptionManager, conn)
+	if errs := h.startOperation(conn, conn.ID(), data); len(errs) > 0 {
+		RemoveConnection(h.config.SubscriptionManager, conn)
+		writeErrorsResponse(w, http.StatusBadRequest, errs)
+		return
+	}
+
+	defer func() {
+		conn.close()
+		h.config.SubscriptionManager.RemoveSubscriptions(conn)
+		RemoveConnection(h.config.SubscriptionManager, conn)
+	}()
+	h.stream(w, r, conn)
+}
+
+// stream sends the events of a connection to the client until either
+// the client or the server closes the connection.
+func (h *sseHandler) stream(w http.ResponseWriter, r *http.Request, conn *sseConnection) {
+	h.logger.WithFields(log.Fields{
+		"conn": conn.ID(),
+		"user": conn.User(),
+	}).Debug("Open stream")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	conn.serve(w, r, h.config.KeepAlive, []byte(":\n\n"))
+}
+
+func (h *sseHandler) authenticate(r *http.Request) (interface{}, error) {
+	return authenticateRequest(h.config.Authenticate, h.config.AuthToken, r)
+}
+
+func (h *sseHandler) startOperation(conn Connection, opID string, data *StartMessagePayload) []error {
+	h.logger.WithFields(log.Fields{
+		"conn": conn.ID(),
+		"op":   opID,
+		"user": conn.User(),
+	}).Debug("Start operation")
+
+	return startOperation(h.config.SubscriptionManager, h.config.PersistedQueries, conn, opID, data)
+}
+
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+/**
+ * An implementation of the Connection interface for SSE clients.
+ */
+
+type sseConnection struct {
+	httpStream
+
+	id     string
+	user   interface{}
+	single bool
+}
+
+func newSSEConnection(user interface{}, single bool) *sseConnection {
+	conn := new(sseConnection)
+	conn.id = uuid.New().String()
+	conn.user = user
+	conn.single = single
+	conn.httpStream = newHTTPStream(NewLogger("sse/" + conn.id))
+	return conn
+}
+
+func (conn *sseConnection) ID() string {
+	return conn.id
+}
+
+func (conn *sseConnection) User() interface{} {
+	return conn.user
+}
+
+func (conn *sseConnection) SendData(opID string, data *DataMessagePayload) {
+	var payload interface{} = data
+	if conn.single {
+		payload = map[string]interface{}{"id": opID, "payload": data}
+	}
+	conn.sendEvent(sseNext, payload)
+}
+
+// SendError sends an error as a result without data; streams in
+// single-connection mode cannot carry errors that are not associated
+// with an operation, so these are dropped.
+func (conn *sseConnection) SendError(err error) {
+	if conn.single {
+		conn.logger.WithField("err", err).Warn("Dropping error for stream")
+		return
+	}
+	conn.sendEvent(sseNext, map[string]interface{}{
+		"errors": errorsForPayload([]error{err}, nil),
+	})
+}
+
+func (conn *sseConnection) sendComplete(opID string) {
+	if conn.single {
+		conn.sendEvent(sseComplete, map[string]interface{}{"id": opID})
+	}
+}
+
+func (conn *sseConnection) sendEvent(event string, payload interface{}) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		conn.logger.WithField("err", err).Warn("Failed to encode event")
+		return
+	}
+	conn.write([]byte(fmt.Sprintf("event: %s\ndata: %s\n\n", event, data)))
+}
@@ -0,0 +1,280 @@
+package graphqlws_test
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/graphql-go/graphql"
+)
+
+func buildSSESchema(t *testing.T) *graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Query",
+			Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name:   "Subscription",
+			Fields: graphql.Fields{"greeting": &graphql.Field{Type: graphql.String}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+// publishGreeting waits until the manager has n subscriptions and
+// sends data to all of them.
+func publishGreeting(t *testing.T, manager graphqlws.SubscriptionManager, n int) {
+	publishGreetingValue(t, manager, n, "hello")
+}
+
+func publishGreetingValue(t *testing.T, manager graphqlws.SubscriptionManager, n int, greeting string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count := 0
+		for _, subscriptions := range manager.Subscriptions() {
+			count += len(subscriptions)
+		}
+		if count >= n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d subscriptions, got %d", n, count)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, subscriptions := range manager.Subscriptions() {
+		for _, subscription := range subscriptions {
+			subscription.SendData(&graphqlws.DataMessagePayload{
+				Data: map[string]interface{}{"greeting": greeting},
+			})
+		}
+	}
+}
+
+// readEvent reads the next event from an event stream, skipping comments.
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	event, data := "", ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal("Failed to read event:", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && event != "":
+			return event, data
+		}
+	}
+}
+
+func TestSSEHandler_DistinctConnectionsMode(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	srv := httptest.NewServer(graphqlws.NewSSEHandler(graphqlws.SSEHandlerConfig{
+		SubscriptionManager: manager,
+	}))
+	defer srv.Close()
+
+	// Invalid operations are rejected before streaming
+	req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(`{"query": "subscription { unknown }"}`))
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Invalid operation is not rejected:", res.Status)
+	}
+
+	req, _ = http.NewRequest("GET", srv.URL+"?query=subscription+%7B+greeting+%7D", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Event stream is not opened:", res.Status)
+	}
+
+	publishGreeting(t, manager, 1)
+
+	event, data := readEvent(t, bufio.NewReader(res.Body))
+	if event != "next" || data != `{"data":{"greeting":"hello"},"errors":null}` {
+		t.Errorf("Unexpected event %q: %s", event, data)
+	}
+
+	// Closing the stream removes the subscription
+	res.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.Subscriptions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription is not removed when the stream is closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSEHandler_SingleConnectionMode(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	srv := httptest.NewServer(graphqlws.NewSSEHandler(graphqlws.SSEHandlerConfig{
+		SubscriptionManager: manager,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+	}))
+	defer srv.Close()
+
+	do := func(method string, url string, body string, header http.Header) *http.Response {
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		for name := range header {
+			req.Header.Set(name, header.Get(name))
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// Reserve a stream
+	res := do("PUT", srv.URL, "", http.Header{"Authorization": {"Bearer alice"}})
+	token, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated || len(token) == 0 {
+		t.Fatal("Stream is not reserved:", res.Status)
+	}
+	header := http.Header{"X-Graphql-Event-Stream-Token": {string(token)}}
+
+	// Operations may be started before the stream is opened
+	res = do("POST", srv.URL, `{"query": "subscription { greeting }", "extensions": {"operationId": "a"}}`, header)
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatal("Operation is not accepted:", res.Status)
+	}
+
+	res = do("POST", srv.URL, `{"query": "subscription { greeting }"}`, header)
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatal("Operation without ID is not rejected:", res.Status)
+	}
+
+	for conn := range manager.Subscriptions() {
+		if conn.User() != "alice" {
+			t.Error("Stream is not authenticated:", conn.User())
+		}
+	}
+
+	header.Set("Accept", "text/event-stream")
+	stream := do("GET", srv.URL, "", header)
+	defer stream.Body.Close()
+	if stream.StatusCode != http.StatusOK {
+		t.Fatal("Event stream is not opened:", stream.Status)
+	}
+
+	res = do("GET", srv.URL, "", header)
+	res.Body.Close()
+	if res.StatusCode != http.StatusConflict {
+		t.Fatal("Event stream is opened twice:", res.Status)
+	}
+
+	publishGreeting(t, manager, 1)
+
+	reader := bufio.NewReader(stream.Body)
+	event, data := readEvent(t, reader)
+	if event != "next" || data != `{"id":"a","payload":{"data":{"greeting":"hello"},"errors":null}}` {
+		t.Errorf("Unexpected event %q: %s", event, data)
+	}
+
+	res = do("DELETE", srv.URL+"?operationId=a", "", header)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Operation is not stopped:", res.Status)
+	}
+	event, data = readEvent(t, reader)
+	if event != "complete" || data != `{"id":"a"}` {
+		t.Errorf("Unexpected event %q: %s", event, data)
+	}
+	if len(manager.Subscriptions()) > 0 {
+		t.Error("Subscription is not removed when the operation is stopped")
+	}
+}
+
+func TestSSEHandler_StalledClientsDoNotBlockPublishers(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	srv := httptest.NewServer(graphqlws.NewSSEHandler(graphqlws.SSEHandlerConfig{
+		SubscriptionManager: manager,
+	}))
+	defer srv.Close()
+
+	// The client opens the stream, but never reads from it
+	req, _ := http.NewRequest("GET", srv.URL+"?query=subscription+%7B+greeting+%7D", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		greeting := strings.Repeat("x", 64*1024)
+		for i := 0; i < 500; i++ {
+			publishGreetingValue(t, manager, 0, greeting)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publishing is blocked by a stalled client")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(manager.Subscriptions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Stalled client is not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSEHandler_RequestBodiesAreLimited(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildSSESchema(t))
+	post := func(config graphqlws.SSEHandlerConfig) *http.Response {
+		config.SubscriptionManager = manager
+		srv := httptest.NewServer(graphqlws.NewSSEHandler(config))
+		defer srv.Close()
+
+		// Queries longer than WebSocket messages are fine
+		query := "subscription {" + strings.Repeat(" ", 8000) + "greeting }"
+		req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(`{"query": "`+query+`"}`))
+		req.Header.Set("Accept", "text/event-stream")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	if res := post(graphqlws.SSEHandlerConfig{}); res.StatusCode != http.StatusOK {
+		t.Error("Long query is rejected:", res.Status)
+	}
+	if res := post(graphqlws.SSEHandlerConfig{MaxBodySize: 1024}); res.StatusCode != http.StatusBadRequest {
+		t.Error("Request body exceeding the limit is not rejected:", res.Status)
+	}
+}
@@ -0,0 +1,257 @@
+package graphqlws
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Building blocks shared by the transports that stream subscription
+// results over plain HTTP responses (SSE and multipart).
+
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// authenticateRequest resolves the auth token of a request into a user.
+func authenticateRequest(
+	authenticate AuthenticateFunc,
+	authToken func(*http.Request) string,
+	r *http.Request,
+) (interface{}, error) {
+	if authenticate == nil {
+		return nil, nil
+	}
+	user, err := authenticate(authToken(r))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to authenticate user: %v", err)
+	}
+	return user, nil
+}
+
+// readOperationRequest reads the GraphQL parameters of an operation from
+// the query string (GET) or the JSON body (POST, up to limit bytes) of a
+// request, along with the operation ID used in SSE single-connection mode.
+func readOperationRequest(w http.ResponseWriter, r *http.Request, limit int64) (*StartMessagePayload, string, error) {
+	var raw []byte
+	if r.Method == http.MethodGet {
+		params := r.URL.Query()
+		request := map[string]json.RawMessage{}
+		query, _ := json.Marshal(params.Get("query"))
+		request["query"] = query
+		if operationName := params.Get("operationName"); operationName != "" {
+			request["operationName"], _ = json.Marshal(operationName)
+		}
+		for _, name := range []string{"variables", "extensions"} {
+			if value := params.Get(name); value != "" {
+				request[name] = json.RawMessage(value)
+			}
+		}
+		var err error
+		if raw, err = json.Marshal(request); err != nil {
+			return nil, "", errors.New("Invalid request parameters")
+		}
+	} else {
+		var err error
+		if raw, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, limit)); err != nil {
+			return nil, "", errors.New("Invalid request body")
+		}
+	}
+
+	data := &StartMessagePayload{}
+	ids := struct {
+		Extensions struct {
+			OperationID string `json:"operationId"`
+		} `json:"extensions"`
+	}{}
+	if json.Unmarshal(raw, data) != nil || json.Unmarshal(raw, &ids) != nil {
+		return nil, "", errors.New("Invalid request parameters")
+	}
+	return data, ids.Extensions.OperationID, nil
+}
+
+// writeErrorsResponse responds with a JSON document of GraphQL errors.
+func writeErrorsResponse(w http.ResponseWriter, status int, errs []error) {
+	writeJSONResponse(w, status, map[string]interface{}{
+		"errors": errorsForPayload(errs, nil),
+	})
+}
+
+func writeJSONResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Number of chunks queued for a stream; clients falling further behind
+// are considered stalled and dropped
+const streamBufferSize = 100
+
+// httpStream streams chunks of an HTTP response to a client. Chunks may
+// be written from any goroutine without blocking; they are queued and
+// sent by the request serving the stream.
+type httpStream struct {
+	logger *log.Entry
+	done   chan struct{}
+	wake   chan struct{}
+
+	mutex   *sync.Mutex
+	pending [][]byte
+	claimed bool
+	closed  bool
+
+	// While the stream is served, abort makes a blocked write fail
+	abort func()
+}
+
+func newHTTPStream(logger *log.Entry) httpStream {
+	return httpStream{
+		logger: logger,
+		done:   make(chan struct{}),
+		wake:   make(chan struct{}, 1),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// serve streams chunks to a response, sending heartbeats at the given
+// interval, until either the client or the server closes the stream.
+// Response headers must be set by the caller.
+func (s *httpStream) serve(w http.ResponseWriter, r *http.Request, interval time.Duration, heartbeat []byte) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeErrorsResponse(w, http.StatusInternalServerError, []error{errors.New("Streaming not supported")})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	controller := http.NewResponseController(w)
+	s.mutex.Lock()
+	s.abort = func() {
+		controller.SetWriteDeadline(time.Now())
+	}
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		s.abort = nil
+		s.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			s.logger.Debug("Stream closed by client")
+			return
+		case <-s.done:
+			// Send what was written before the stream was closed
+			s.send(w, controller, flusher, s.take())
+			return
+		case <-s.wake:
+			if !s.send(w, controller, flusher, s.take()) {
+				return
+			}
+		case <-ticker.C:
+			if !s.send(w, controller, flusher, [][]byte{heartbeat}) {
+				return
+			}
+		}
+	}
+}
+
+// write queues a chunk for the client. Streams of clients that do not
+// keep up are closed rather than holding up the writer.
+func (s *httpStream) write(chunk []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+	if len(s.pending) >= streamBufferSize {
+		s.logger.Warn("Stream buffer overflowed, dropping client")
+		s.pending = nil
+		if s.abort != nil {
+			s.abort()
+		}
+		s.closeLocked()
+		return
+	}
+	s.pending = append(s.pending, chunk)
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the chunks queued so far.
+func (s *httpStream) take() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	chunks := s.pending
+	s.pending = nil
+	return chunks
+}
+
+// send writes chunks to the response, giving up on clients that do not
+// accept them within the write timeout. It returns false if writing
+// fails, closing the stream.
+func (s *httpStream) send(w http.ResponseWriter, controller *http.ResponseController, flusher http.Flusher, chunks [][]byte) bool {
+	if len(chunks) == 0 {
+		return true
+	}
+
+	// Not all response writers support deadlines; those are written to
+	// without one
+	controller.SetWriteDeadline(time.Now().Add(writeTimeout))
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			s.logger.WithField("err", err).Warn("Sending chunk failed")
+			s.close()
+			return false
+		}
+	}
+	flusher.Flush()
+	return true
+}
+
+// claim marks the stream as being served by a request; it returns false
+// if another request has claimed it before.
+func (s *httpStream) claim() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.claimed {
+		return false
+	}
+	s.claimed = true
+	return true
+}
+
+func (s *httpStream) isClaimed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.claimed
+}
+
+func (s *httpStream) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closeLocked()
+}
+
+func (s *httpStream) closeLocked() {
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+}
@@ -2,11 +2,11 @@ package graphqlws
 
 import (
 	"errors"
+	"sync"
 
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/graphql/gqlerrors"
 	"github.com/graphql-go/graphql/language/ast"
-	"github.com/graphql-go/graphql/language/parser"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -35,6 +35,7 @@ type Subscription struct {
 	Query         string
 	Variables     map[string]interface{}
 	OperationName string
+	Extensions    *StartMessageExtensions
 	Document      *ast.Document
 	Fields        []string
 	Connection    Connection
@@ -87,31 +88,146 @@ type SubscriptionManager interface {
  * The default implementation of the SubscriptionManager interface.
  */
 
+// SubscriptionManagerConfig defines the configuration parameters of
+// a subscription manager.
+type SubscriptionManagerConfig struct {
+	// Schema is the GraphQL schema subscriptions are validated against.
+	Schema *graphql.Schema
+
+	// Logger is used for logging; defaults to a "subscriptions" logger.
+	Logger *log.Entry
+
+	// DocumentCache is an optional cache for parsed and validated
+	// subscription queries.
+	DocumentCache DocumentCache
+
+	// Allowlist optionally restricts subscriptions to trusted documents.
+	Allowlist OperationAllowlist
+
+	// Limits optionally restricts the depth and complexity of
+	// subscription queries.
+	Limits *QueryLimits
+
+	// OperationLimits optionally restricts the number of active
+	// subscriptions and how quickly they are started.
+	OperationLimits *OperationLimits
+
+	// UserKey derives the key connections are indexed by for
+	// SubscriptionsForUser; defaults to the UserKey of the operation
+	// limits, or the string representation of Connection.User().
+	UserKey UserKeyFunc
+}
+
 type subscriptionManager struct {
+	mutex         *sync.Mutex
 	subscriptions Subscriptions
 	schema        *graphql.Schema
 	logger        *log.Entry
+	documents     DocumentCache
+	allowlist     OperationAllowlist
+	limits        *QueryLimits
+
+	operationLimits *OperationLimits
+	operations      int
+	userOperations  map[string]int
+	startLimiters   map[Connection]*tokenBucket
+
+	// User keys operations were counted for, as users of connections
+	// may change when they are initialized again
+	operationUsers map[*Subscription]string
+
+	// Connections with subscriptions by user key
+	userKey         UserKeyFunc
+	userConnections map[string]map[Connection]bool
 }
 
 func NewSubscriptionManagerWithLogger(schema *graphql.Schema, logger *log.Entry) SubscriptionManager {
-	return newSubscriptionManager(schema, logger)
+	return newSubscriptionManager(SubscriptionManagerConfig{
+		Schema: schema,
+		Logger: logger,
+	})
 }
 
 // NewSubscriptionManager creates a new subscription manager.
 func NewSubscriptionManager(schema *graphql.Schema) SubscriptionManager {
-	return newSubscriptionManager(schema, NewLogger("subscriptions"))
+	return newSubscriptionManager(SubscriptionManagerConfig{
+		Schema: schema,
+	})
+}
+
+// NewSubscriptionManagerWithConfig creates a new subscription manager
+// from the given configuration.
+func NewSubscriptionManagerWithConfig(config SubscriptionManagerConfig) SubscriptionManager {
+	return newSubscriptionManager(config)
 }
 
-func newSubscriptionManager(schema *graphql.Schema, logger *log.Entry) SubscriptionManager {
+func newSubscriptionManager(config SubscriptionManagerConfig) *subscriptionManager {
 	manager := new(subscriptionManager)
+	manager.mutex = &sync.Mutex{}
 	manager.subscriptions = make(Subscriptions)
-	manager.logger = logger
-	manager.schema = schema
+	manager.logger = config.Logger
+	if manager.logger == nil {
+		manager.logger = NewLogger("subscriptions")
+	}
+	manager.schema = config.Schema
+	manager.documents = config.DocumentCache
+	manager.allowlist = config.Allowlist
+	manager.limits = config.Limits
+	manager.operationLimits = config.OperationLimits
+	manager.userOperations = make(map[string]int)
+	manager.startLimiters = make(map[Connection]*tokenBucket)
+	manager.operationUsers = make(map[*Subscription]string)
+	manager.userKey = config.UserKey
+	if manager.userKey == nil && config.OperationLimits != nil {
+		manager.userKey = config.OperationLimits.UserKey
+	}
+	if manager.userKey == nil {
+		manager.userKey = defaultUserKey
+	}
+	manager.userConnections = make(map[string]map[Connection]bool)
 	return manager
 }
 
+// Subscriptions returns a snapshot of the registered subscriptions,
+// which is safe to iterate while subscriptions are added and removed.
 func (m *subscriptionManager) Subscriptions() Subscriptions {
-	return m.subscriptions
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out := make(Subscriptions, len(m.subscriptions))
+	for conn := range m.subscriptions {
+		out[conn] = m.copyConnectionSubscriptions(conn)
+	}
+	return out
+}
+
+// UserSubscriptions returns a snapshot of the subscriptions of the
+// connections of a user.
+func (m *subscriptionManager) UserSubscriptions(key string) Subscriptions {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	out := make(Subscriptions, len(m.userConnections[key]))
+	for conn := range m.userConnections[key] {
+		out[conn] = m.copyConnectionSubscriptions(conn)
+	}
+	return out
+}
+
+// ConnectionSubscriptions returns a snapshot of the subscriptions of a
+// connection.
+func (m *subscriptionManager) ConnectionSubscriptions(conn Connection) ConnectionSubscriptions {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.copyConnectionSubscriptions(conn)
+}
+
+func (m *subscriptionManager) copyConnectionSubscriptions(conn Connection) ConnectionSubscriptions {
+	out := make(ConnectionSubscriptions, len(m.subscriptions[conn]))
+	for id, subscription := range m.subscriptions[conn] {
+		out[id] = subscription
+	}
+	return out
 }
 
 func (m *subscriptionManager) AddSubscription(
@@ -128,29 +244,55 @@ func (m *subscriptionManager) AddSubscription(
 		return errors
 	}
 
-	// Parse the subscription query
-	document, err := parser.Parse(parser.ParseParams{
-		Source: subscription.Query,
-	})
-	if err != nil {
-		m.logger.WithField("err", err).Warn("Failed to parse subscription query")
-		return []error{err}
+	// Enforce limits on the number of active operations
+	m.mutex.Lock()
+	errs := m.checkOperationLimits(conn)
+	m.mutex.Unlock()
+	if len(errs) > 0 {
+		m.logger.WithFields(log.Fields{
+			"conn":         conn.ID(),
+			"subscription": subscription.ID,
+			"errors":       errs,
+		}).Warn("Subscription exceeds operation limits")
+		return errs
+	}
+
+	// Parse and validate the subscription query
+	document, errs := m.parseDocument(subscription.Query)
+	if len(errs) > 0 {
+		return errs
 	}
 
-	// Validate the query document
-	validation := graphql.ValidateDocument(m.schema, document, nil)
-	if !validation.IsValid {
+	// Reject documents that are not trusted
+	if m.allowlist != nil && !m.allowlist.Allows(document.Document) {
 		m.logger.WithFields(log.Fields{
-			"errors": validation.Errors,
-		}).Warn("Failed to validate subscription query")
-		return ErrorsFromGraphQLErrors(validation.Errors)
+			"conn":         conn.ID(),
+			"subscription": subscription.ID,
+		}).Warn("Subscription operation is not in the allowlist")
+		return []error{ErrOperationNotAllowed}
+	}
+
+	// Reject queries that are too deep or too complex
+	if m.limits != nil {
+		if errs := m.limits.Check(m.schema, document.Document); len(errs) > 0 {
+			m.logger.WithField("errors", errs).Warn("Subscription query exceeds limits")
+			return errs
+		}
 	}
 
 	// Remember the query document for later
-	subscription.Document = document
+	subscription.Document = document.Document
 
 	// Extract query names from the document (typically, there should only be one)
-	subscription.Fields = subscriptionFieldNamesFromDocument(document)
+	subscription.Fields = document.Fields
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Other connections may have started operations in the meantime
+	if errs := m.checkOperationCounts(conn); len(errs) > 0 {
+		return errs
+	}
 
 	// Allocate the connection's map of subscription IDs to
 	// subscriptions on demand
@@ -168,10 +310,105 @@ func (m *subscriptionManager) AddSubscription(
 	}
 
 	m.subscriptions[conn][subscription.ID] = subscription
+	m.countOperation(conn, subscription)
+
+	return nil
+}
+
+// checkOperationLimits checks whether a connection may start another
+// operation.
+func (m *subscriptionManager) checkOperationLimits(conn Connection) []error {
+	limits := m.operationLimits
+	if limits == nil {
+		return nil
+	}
+
+	// Every start counts towards the rate limit, including those that fail
+	if limits.StartsPerSecond > 0 {
+		limiter := m.startLimiters[conn]
+		if limiter == nil {
+			limiter = newTokenBucket(limits.StartsPerSecond, limits.StartBurst)
+			m.startLimiters[conn] = limiter
+		}
+		if !limiter.allow() {
+			return []error{ErrStartRateLimit}
+		}
+	}
+
+	return m.checkOperationCounts(conn)
+}
+
+// checkOperationCounts checks whether the number of active operations
+// leaves room for another operation of a connection.
+func (m *subscriptionManager) checkOperationCounts(conn Connection) []error {
+	limits := m.operationLimits
+	if limits == nil {
+		return nil
+	}
+
+	if limits.MaxPerConnection > 0 && len(m.subscriptions[conn]) >= limits.MaxPerConnection {
+		return []error{ErrConnectionOperationLimit}
+	}
+
+	if limits.MaxPerUser > 0 {
+		if key := limits.userKey(conn); key != "" && m.userOperations[key] >= limits.MaxPerUser {
+			return []error{ErrUserOperationLimit}
+		}
+	}
+
+	if limits.MaxTotal > 0 && m.operations >= limits.MaxTotal {
+		return []error{ErrGlobalOperationLimit}
+	}
 
 	return nil
 }
 
+// countOperation keeps track of the number of active operations
+// overall and per user.
+func (m *subscriptionManager) countOperation(conn Connection, subscription *Subscription) {
+	m.operations++
+
+	if m.operationLimits != nil && m.operationLimits.MaxPerUser > 0 {
+		if key := m.operationLimits.userKey(conn); key != "" {
+			m.userOperations[key]++
+			m.operationUsers[subscription] = key
+		}
+	}
+}
+
+// uncountOperation stops counting an operation, for the user it was
+// counted for.
+func (m *subscriptionManager) uncountOperation(subscription *Subscription) {
+	m.operations--
+
+	if key, ok := m.operationUsers[subscription]; ok {
+		delete(m.operationUsers, subscription)
+		m.userOperations[key]--
+		if m.userOperations[key] <= 0 {
+			delete(m.userOperations, key)
+		}
+	}
+}
+
+// parseDocument parses a query and validates it against the schema,
+// consulting the document cache first if there is one.
+func (m *subscriptionManager) parseDocument(query string) (*CachedDocument, []error) {
+	document, err := loadDocument(m.schema, m.documents, query)
+	if err != nil {
+		m.logger.WithField("err", err).Warn("Failed to parse subscription query")
+		return nil, []error{err}
+	}
+
+	if len(document.Errors) > 0 {
+		m.logger.WithFields(log.Fields{
+			"errors": document.Errors,
+		}).Warn("Failed to validate subscription query")
+		return document, document.Errors
+	}
+
+	return document, nil
+}
+
 func (m *subscriptionManager) RemoveSubscription(
 	conn Connection,
 	subscription *Subscription,
@@ -181,11 +418,21 @@ func (m *subscriptionManager) RemoveSubscription(
 		"subscription": subscription.ID,
 	}).Info("Remove subscription")
 
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeSubscription(conn, subscription.ID)
+}
+
+// removeSubscription removes a subscription; the mutex must be held.
+func (m *subscriptionManager) removeSubscription(conn Connection, id string) {
 	// Remove the subscription from its connections' subscription map
-	delete(m.subscriptions[conn], subscription.ID)
+	if subscription, ok := m.subscriptions[conn][id]; ok {
+		delete(m.subscriptions[conn], id)
+		m.uncountOperation(subscription)
+	}
 
 	// Remove the connection as well if there are no subscriptions left
-	if len(m.subscriptions[conn]) == 0 {
+	if subscriptions, ok := m.subscriptions[conn]; ok && len(subscriptions) == 0 {
 		delete(m.subscriptions, conn)
 	}
 }
@@ -195,16 +442,133 @@ func (m *subscriptionManager) RemoveSubscriptions(conn Connection) {
 		"conn": conn.ID(),
 	}).Info("Remove subscriptions")
 
-	// Only remove subscriptions if we know the connection
-	if m.subscriptions[conn] != nil {
-		// Remove subscriptions one by one
-		for opID := range m.subscriptions[conn] {
-			m.RemoveSubscription(conn, m.subscriptions[conn][opID])
-		}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
-		// Remove the connection's subscription map altogether
-		delete(m.subscriptions, conn)
+	// Remove subscriptions one by one, which removes the connection
+	// along with its last subscription
+	for opID := range m.subscriptions[conn] {
+		m.removeSubscription(conn, opID)
 	}
+
+	// Forget the connection's start rate limiter
+	delete(m.startLimiters, conn)
+}
+
+// Schema returns the schema subscriptions are validated against.
+func (m *subscriptionManager) Schema() *graphql.Schema {
+	return m.schema
+}
+
+// UserKey derives the key connections are indexed by from their user.
+func (m *subscriptionManager) UserKey(user interface{}) string {
+	return m.userKey(user)
+}
+
+// AddConnection adds a connection to the index of its user, once it
+// has been authenticated.
+func (m *subscriptionManager) AddConnection(conn Connection) {
+	key := m.userKey(conn.User())
+	if key == "" {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.userConnections[key] == nil {
+		m.userConnections[key] = make(map[Connection]bool)
+	}
+	m.userConnections[key][conn] = true
+}
+
+// RemoveConnection removes a closed connection from the index of its
+// user.
+func (m *subscriptionManager) RemoveConnection(conn Connection) {
+	key := m.userKey(conn.User())
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.userConnections[key], conn)
+	if len(m.userConnections[key]) == 0 {
+		delete(m.userConnections, key)
+	}
+}
+
+// AddConnection announces an authenticated connection to subscription
+// managers that index connections by user; handlers call it for every
+// connection they open.
+func AddConnection(manager SubscriptionManager, conn Connection) {
+	if m, ok := manager.(interface {
+		AddConnection(Connection)
+	}); ok {
+		m.AddConnection(conn)
+	}
+}
+
+// RemoveConnection announces that a connection has been closed to
+// subscription managers that index connections by user.
+func RemoveConnection(manager SubscriptionManager, conn Connection) {
+	if m, ok := manager.(interface {
+		RemoveConnection(Connection)
+	}); ok {
+		m.RemoveConnection(conn)
+	}
+}
+
+// connectionSubscriptions returns the subscriptions of a connection,
+// looking them up directly in managers that support it.
+func connectionSubscriptions(manager SubscriptionManager, conn Connection) ConnectionSubscriptions {
+	if m, ok := manager.(interface {
+		ConnectionSubscriptions(Connection) ConnectionSubscriptions
+	}); ok {
+		return m.ConnectionSubscriptions(conn)
+	}
+	return manager.Subscriptions()[conn]
+}
+
+// managerSchema returns the schema of a subscription manager, or nil
+// for managers that don't tell.
+func managerSchema(manager SubscriptionManager) *graphql.Schema {
+	if m, ok := manager.(interface {
+		Schema() *graphql.Schema
+	}); ok {
+		return m.Schema()
+	}
+	return nil
+}
+
+// managerUserKey returns the function a subscription manager derives
+// user keys with, or the default one for managers without their own.
+func managerUserKey(manager SubscriptionManager) UserKeyFunc {
+	if m, ok := manager.(interface {
+		UserKey(interface{}) string
+	}); ok {
+		return m.UserKey
+	}
+	return defaultUserKey
+}
+
+// SubscriptionsForUser returns the subscriptions of all connections of
+// a user, identified by the user key derived from Connection.User().
+// Subscription managers created by this package, and the managers
+// wrapping them, look these up in an index of the connections announced
+// with AddConnection and not yet removed with RemoveConnection; for
+// other managers, all subscriptions are scanned for matching users.
+func SubscriptionsForUser(manager SubscriptionManager, key string) Subscriptions {
+	if m, ok := manager.(interface {
+		UserSubscriptions(key string) Subscriptions
+	}); ok {
+		return m.UserSubscriptions(key)
+	}
+
+	userKey := managerUserKey(manager)
+	out := make(Subscriptions)
+	for conn, subscriptions := range manager.Subscriptions() {
+		if userKey(conn.User()) == key {
+			out[conn] = subscriptions
+		}
+	}
+	return out
 }
 
 func validateSubscription(s *Subscription) []error {
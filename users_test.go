@@ -0,0 +1,163 @@
+package graphqlws_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/functionalfoundry/graphqlws"
+	"github.com/functionalfoundry/graphqlws/graphqlwstest"
+)
+
+type testUser struct {
+	ID   string
+	Name string
+}
+
+func TestPublishToUser_ReachesAllConnectionsOfUser(t *testing.T) {
+	schema := buildMessageSchema(t)
+	bridge := graphqlws.NewPubSubBridge(graphqlws.PubSubBridgeConfig{
+		Schema: schema,
+		SubscriptionManager: graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+			Schema: schema,
+			UserKey: func(user interface{}) string {
+				return user.(testUser).ID
+			},
+		}),
+		Topic: channelTopic,
+	})
+	defer bridge.Close()
+
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: bridge,
+		Authenticate: func(token string) (interface{}, error) {
+			return testUser{ID: token, Name: "User " + token}, nil
+		},
+	})
+	defer srv.Close()
+
+	alice1, alice2, bob := srv.Dial(t), srv.Dial(t), srv.Dial(t)
+	for client, token := range map[*graphqlwstest.Client]string{alice1: "alice", alice2: "alice", bob: "bob"} {
+		defer client.Close()
+		client.Init(graphqlws.InitMessagePayload{AuthToken: token})
+		client.ExpectAck()
+		client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+		client.Start("probe", "{", nil)
+		client.ExpectError("probe")
+	}
+
+	if subscriptions := graphqlws.SubscriptionsForUser(bridge, "alice"); len(subscriptions) != 2 {
+		t.Error("Connections of the user are not indexed:", subscriptions)
+	}
+
+	bridge.PublishToUser("alice", "messageAdded.general", map[string]interface{}{"text": "Hi Alice"})
+	alice1.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "Hi Alice"}}`))
+	alice2.ExpectData("1", graphqlwstest.EqualJSON(`{"messageAdded": {"text": "Hi Alice"}}`))
+	bob.ExpectNoMessage(100 * time.Millisecond)
+
+	// Closed connections leave the index
+	alice1.Terminate()
+	alice1.ExpectClosed()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(graphqlws.SubscriptionsForUser(bridge, "alice")) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Closed connection is still indexed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// scanningManager hides the user index of a subscription manager, but
+// shares its user keys.
+type scanningManager struct {
+	graphqlws.SubscriptionManager
+	userKey graphqlws.UserKeyFunc
+}
+
+func (m scanningManager) UserKey(user interface{}) string {
+	return m.userKey(user)
+}
+
+func TestSubscriptionsForUser_IndexesConnectionsWhileOpen(t *testing.T) {
+	userKey := func(user interface{}) string {
+		return user.(testUser).ID
+	}
+	manager := graphqlws.NewSubscriptionManagerWithConfig(graphqlws.SubscriptionManagerConfig{
+		Schema:  buildMessageSchema(t),
+		UserKey: userKey,
+	})
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Authenticate: func(token string) (interface{}, error) {
+			return testUser{ID: token, Name: "User " + token}, nil
+		},
+	})
+	defer srv.Close()
+
+	waitForConnections := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(graphqlws.SubscriptionsForUser(manager, "alice")) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %d indexed connections, got %d", n, len(graphqlws.SubscriptionsForUser(manager, "alice")))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Connections are indexed from the start, not just while they have
+	// subscriptions
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice"})
+	client.ExpectAck()
+	waitForConnections(1)
+
+	client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+	client.Stop("1")
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+	waitForConnections(1)
+
+	// Managers without an index are scanned using their user keys
+	client.Start("2", `subscription { messageAdded(channel: "general") { text } }`, nil)
+	client.Start("probe", "{", nil)
+	client.ExpectError("probe")
+	if subscriptions := graphqlws.SubscriptionsForUser(scanningManager{manager, userKey}, "alice"); len(subscriptions) != 1 {
+		t.Error("Subscriptions are not found by configured user key:", subscriptions)
+	}
+
+	client.Terminate()
+	client.ExpectClosed()
+	waitForConnections(0)
+}
+
+func TestSubscriptionsForUser_ConnectionsCannotSwitchUsers(t *testing.T) {
+	manager := graphqlws.NewSubscriptionManager(buildMessageSchema(t))
+	srv := graphqlwstest.NewServer(graphqlws.HandlerConfig{
+		SubscriptionManager: manager,
+		Authenticate: func(token string) (interface{}, error) {
+			return token, nil
+		},
+	})
+	defer srv.Close()
+
+	client := srv.Dial(t)
+	defer client.Close()
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "alice"})
+	client.ExpectAck()
+	client.Start("1", `subscription { messageAdded(channel: "general") { text } }`, nil)
+
+	client.Init(graphqlws.InitMessagePayload{AuthToken: "mallory"})
+	msg := client.ExpectConnectionError()
+	if !strings.Contains(string(msg.Payload), graphqlws.ErrConnectionAlreadyInitialized.Error()) {
+		t.Errorf("Unexpected connection error: %s", msg.Payload)
+	}
+
+	if subscriptions := graphqlws.SubscriptionsForUser(manager, "mallory"); len(subscriptions) != 0 {
+		t.Error("Connection is indexed for another user:", subscriptions)
+	}
+	if subscriptions := graphqlws.SubscriptionsForUser(manager, "alice"); len(subscriptions) != 1 {
+		t.Error("Connection is not indexed for its user anymore:", subscriptions)
+	}
+}